@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Limits of history backfill requests. The phone answers asynchronously, and
+// jobs it has not answered within backfillTimeout are considered expired.
+const (
+	defaultBackfillCount = 50
+	maxBackfillCount     = 500
+	backfillTimeout      = 5 * time.Minute
+)
+
+// States of a backfill job
+const (
+	backfillPending   = "pending"
+	backfillCompleted = "completed"
+	backfillExpired   = "expired"
+)
+
+var errBackfillJobNotFound = errors.New("backfill job not found")
+
+// Request for older messages of a chat sent to the primary phone
+type backfillJob struct {
+	Id             string
+	Chat           string
+	BeforeId       string
+	Count          int
+	Status         string
+	Messages       int
+	StoredMessages int
+	OldestId       string `json:",omitempty"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func newBackfillJobID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Asks the primary phone for up to count messages of a chat sent before the
+// given message and records the job, which completes when the phone sends
+// the requested history
+func requestBackfill(ctx context.Context, client *whatsmeow.Client, db *sql.DB, userID int, before *indexedMessage, count int) (*backfillJob, error) {
+	ownID := client.Store.ID
+	if ownID == nil {
+		return nil, errors.New("not logged in")
+	}
+
+	now := time.Now()
+	job := &backfillJob{
+		Id:        newBackfillJobID(),
+		Chat:      before.Chat.ToNonAD().String(),
+		BeforeId:  before.ID,
+		Count:     count,
+		Status:    backfillPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO backfill_jobs (id, user_id, chat_jid, before_id, count, status, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	case "postgresql":
+		sqlStmt = `INSERT INTO backfill_jobs (id, user_id, chat_jid, before_id, count, status, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if _, err := db.Exec(sqlStmt, job.Id, userID, job.Chat, job.BeforeId, job.Count, job.Status, now.Unix(), now.Unix()); err != nil {
+		return nil, err
+	}
+
+	msg := client.BuildHistorySyncRequest(before.Info(), count)
+	if _, err := client.SendMessage(ctx, ownID.ToNonAD(), msg, whatsmeow.SendRequestExtra{Peer: true}); err != nil {
+		deleteBackfillJob(db, job.Id)
+		return nil, fmt.Errorf("failed to request history: %w", err)
+	}
+	return job, nil
+}
+
+func deleteBackfillJob(db *sql.DB, id string) {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`DELETE FROM backfill_jobs WHERE id = ?`, id)
+	case "postgresql":
+		_, err = db.Exec(`DELETE FROM backfill_jobs WHERE id = $1`, id)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("job", id).Msg("Failed to delete backfill job")
+	}
+}
+
+// Completes the oldest pending backfill job of a chat with the result of an
+// on demand history sync. Returns the ID of the job, empty if there was none.
+func completeBackfillJob(db *sql.DB, userID int, result *historyChatResult) (string, error) {
+	chat := result.JID.ToNonAD().String()
+	since := time.Now().Add(-backfillTimeout).Unix()
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT id FROM backfill_jobs WHERE user_id = ? AND chat_jid = ? AND status = ? AND created_at >= ?
+			ORDER BY created_at LIMIT 1`, userID, chat, backfillPending, since)
+	case "postgresql":
+		row = db.QueryRow(`SELECT id FROM backfill_jobs WHERE user_id = $1 AND chat_jid = $2 AND status = $3 AND created_at >= $4
+			ORDER BY created_at LIMIT 1`, userID, chat, backfillPending, since)
+	default:
+		return "", fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var id string
+	if err := row.Scan(&id); errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE backfill_jobs SET status = ?, messages = ?, stored_messages = ?, oldest_id = ?, updated_at = ? WHERE id = ?`,
+			backfillCompleted, result.Messages, result.StoredMessages, result.OldestID, now, id)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE backfill_jobs SET status = $1, messages = $2, stored_messages = $3, oldest_id = $4, updated_at = $5 WHERE id = $6`,
+			backfillCompleted, result.Messages, result.StoredMessages, result.OldestID, now, id)
+	}
+	return id, err
+}
+
+// Returns a backfill job of a user. Pending jobs the phone did not answer in
+// time are reported as expired.
+func getBackfillJob(db *sql.DB, userID int, id string) (*backfillJob, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT id, chat_jid, before_id, count, status, messages, stored_messages, oldest_id, created_at, updated_at
+			FROM backfill_jobs WHERE user_id = ? AND id = ?`, userID, id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT id, chat_jid, before_id, count, status, messages, stored_messages, oldest_id, created_at, updated_at
+			FROM backfill_jobs WHERE user_id = $1 AND id = $2`, userID, id)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	var job backfillJob
+	var createdAt, updatedAt int64
+	err := row.Scan(&job.Id, &job.Chat, &job.BeforeId, &job.Count, &job.Status, &job.Messages, &job.StoredMessages, &job.OldestId,
+		&createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errBackfillJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+
+	if job.Status == backfillPending && time.Since(job.CreatedAt) > backfillTimeout {
+		job.Status = backfillExpired
+		job.UpdatedAt = time.Now()
+		switch dbType {
+		case "sqlite3":
+			_, err = db.Exec(`UPDATE backfill_jobs SET status = ?, updated_at = ? WHERE id = ?`, job.Status, job.UpdatedAt.Unix(), job.Id)
+		case "postgresql":
+			_, err = db.Exec(`UPDATE backfill_jobs SET status = $1, updated_at = $2 WHERE id = $3`, job.Status, job.UpdatedAt.Unix(), job.Id)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("job", job.Id).Msg("Failed to expire backfill job")
+		}
+	}
+	return &job, nil
+}
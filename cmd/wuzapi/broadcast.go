@@ -0,0 +1,803 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// States of a broadcast
+const (
+	broadcastRunning   = "running"
+	broadcastPaused    = "paused"
+	broadcastCompleted = "completed"
+	broadcastCancelled = "cancelled"
+)
+
+// States of a broadcast recipient. Invalid recipients are not on WhatsApp.
+const (
+	recipientPending   = "pending"
+	recipientSending   = "sending"
+	recipientSent      = "sent"
+	recipientFailed    = "failed"
+	recipientInvalid   = "invalid"
+	recipientCancelled = "cancelled"
+)
+
+const (
+	maxBroadcastRecipients   = 10000
+	broadcastPollInterval    = 2 * time.Second
+	broadcastCheckBatchSize  = 50
+	minBroadcastCheckBackoff = 10 * time.Second
+	maxBroadcastCheckBackoff = 5 * time.Minute
+	defaultRecipientsLimit   = 100
+	maxRecipientsLimit       = 1000
+	defaultBroadcastsLimit   = 100
+	broadcastPhoneColumnName = "phone"
+)
+
+var (
+	errBroadcastNotFound   = errors.New("broadcast not found")
+	errBroadcastFinished   = errors.New("broadcast already finished")
+	errBroadcastNotRunning = errors.New("broadcast is not running")
+	errBroadcastNotPaused  = errors.New("broadcast is not paused")
+)
+
+// Recipient of a broadcast with the values for the variables of the message
+type broadcastRecipient struct {
+	Phone     string
+	Variables map[string]string `json:",omitempty"`
+}
+
+// Bulk send of a text message to a list of recipients. The body is a Go
+// template filled with the variables of each recipient.
+type broadcastJob struct {
+	Id            string
+	Name          string
+	Body          string
+	Status        string
+	PerMinute     int
+	JitterSeconds int
+	Typing        bool
+	CreatedAt     time.Time
+	FinishedAt    *time.Time `json:",omitempty"`
+	Stats         broadcastStats
+}
+
+// Counts of the recipients of a broadcast by status, plus how many of the
+// sent messages were delivered and read
+type broadcastStats struct {
+	Total     int
+	Pending   int
+	Sent      int
+	Failed    int
+	Invalid   int
+	Cancelled int
+	Delivered int
+	Read      int
+}
+
+// Outcome of a broadcast for one recipient
+type broadcastRecipientResult struct {
+	Phone       string
+	Jid         string `json:",omitempty"`
+	Status      string
+	MessageId   string     `json:",omitempty"`
+	Error       string     `json:",omitempty"`
+	SentAt      *time.Time `json:",omitempty"`
+	DeliveredAt *time.Time `json:",omitempty"`
+	ReadAt      *time.Time `json:",omitempty"`
+}
+
+func newBroadcastID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Keeps only the digits of a phone number, as IsOnWhatsApp expects
+func normalizePhone(phone string) string {
+	var sb strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Reads recipients from a CSV file with a header row. The phone column holds
+// the numbers and every other column is a variable named after its header.
+func parseRecipientsCSV(r io.Reader) ([]broadcastRecipient, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty recipients file")
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid recipients file: %w", err)
+	}
+
+	phoneColumn := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if strings.EqualFold(header[i], broadcastPhoneColumnName) {
+			phoneColumn = i
+		}
+	}
+	if phoneColumn < 0 {
+		return nil, errors.New("recipients file has no phone column")
+	}
+
+	var recipients []broadcastRecipient
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid recipients file: %w", err)
+		}
+		recipient := broadcastRecipient{Phone: record[phoneColumn], Variables: map[string]string{}}
+		for i, value := range record {
+			if i != phoneColumn {
+				recipient.Variables[header[i]] = value
+			}
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// Normalizes the recipients of a new broadcast, dropping repeated numbers,
+// and checks that the body renders for each of them
+func prepareBroadcastRecipients(body string, recipients []broadcastRecipient) ([]broadcastRecipient, error) {
+	tmpl, err := parseMessageTemplate(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Body template: %w", err)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("missing Recipients in Payload")
+	}
+
+	seen := make(map[string]bool, len(recipients))
+	unique := make([]broadcastRecipient, 0, len(recipients))
+	for i, recipient := range recipients {
+		phone := normalizePhone(recipient.Phone)
+		if phone == "" {
+			return nil, fmt.Errorf("recipient %d has no valid Phone", i+1)
+		}
+		if seen[phone] {
+			continue
+		}
+		seen[phone] = true
+		if _, err := renderMessageTemplate(tmpl, recipient.Variables); err != nil {
+			return nil, fmt.Errorf("could not render Body for recipient %d: %w", i+1, err)
+		}
+		recipient.Phone = phone
+		unique = append(unique, recipient)
+	}
+	if len(unique) > maxBroadcastRecipients {
+		return nil, fmt.Errorf("a broadcast can have at most %d recipients", maxBroadcastRecipients)
+	}
+	return unique, nil
+}
+
+// Stores a new broadcast, which starts running right away
+func createBroadcast(db *sql.DB, userID int, job *broadcastJob, recipients []broadcastRecipient) error {
+	job.Status = broadcastRunning
+	job.CreatedAt = time.Now()
+
+	var jobStmt, recipientStmt string
+	switch dbType {
+	case "sqlite3":
+		jobStmt = `INSERT INTO broadcasts (user_id, broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		recipientStmt = `INSERT INTO broadcast_recipients (user_id, broadcast_id, position, phone, variables, status) VALUES (?, ?, ?, ?, ?, ?)`
+	case "postgresql":
+		jobStmt = `INSERT INTO broadcasts (user_id, broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		recipientStmt = `INSERT INTO broadcast_recipients (user_id, broadcast_id, position, phone, variables, status) VALUES ($1, $2, $3, $4, $5, $6)`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(jobStmt, userID, job.Id, job.Name, job.Body, job.Status, job.PerMinute, job.JitterSeconds, job.Typing,
+		job.CreatedAt.UnixMilli()); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(recipientStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, recipient := range recipients {
+		variables, err := json.Marshal(recipient.Variables)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(userID, job.Id, i, recipient.Phone, string(variables), recipientPending); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanBroadcast(scan func(dest ...interface{}) error) (*broadcastJob, error) {
+	var job broadcastJob
+	var createdAt, finishedAt int64
+	if err := scan(&job.Id, &job.Name, &job.Body, &job.Status, &job.PerMinute, &job.JitterSeconds, &job.Typing,
+		&createdAt, &finishedAt); err != nil {
+		return nil, err
+	}
+	job.CreatedAt = time.UnixMilli(createdAt)
+	job.FinishedAt = optUnixMilli(finishedAt)
+	return &job, nil
+}
+
+// Gets a broadcast without its stats
+func getBroadcast(db *sql.DB, userID int, id string) (*broadcastJob, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = ? AND broadcast_id = ?`, userID, id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = $1 AND broadcast_id = $2`, userID, id)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	job, err := scanBroadcast(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errBroadcastNotFound
+	}
+	return job, err
+}
+
+// Gets a broadcast with its stats
+func getBroadcastWithStats(db *sql.DB, userID int, id string) (*broadcastJob, error) {
+	job, err := getBroadcast(db, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Stats, err = getBroadcastStats(db, userID, id); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Returns the latest broadcasts of a user with their stats
+func listBroadcasts(db *sql.DB, userID int, limit int) ([]broadcastJob, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = ? ORDER BY created_at DESC LIMIT ?`, userID, limit)
+	case "postgresql":
+		rows, err = db.Query(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`, userID, limit)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []broadcastJob{}
+	for rows.Next() {
+		job, err := scanBroadcast(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range jobs {
+		if jobs[i].Stats, err = getBroadcastStats(db, userID, jobs[i].Id); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// Counts the recipients of a broadcast by status, and the messages sent to
+// them that were delivered and read according to their receipts
+func getBroadcastStats(db *sql.DB, userID int, id string) (broadcastStats, error) {
+	var stats broadcastStats
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT r.status, COUNT(*),
+				SUM(CASE WHEN s.delivered_at > 0 OR s.read_at > 0 OR s.played_at > 0 THEN 1 ELSE 0 END),
+				SUM(CASE WHEN s.read_at > 0 OR s.played_at > 0 THEN 1 ELSE 0 END)
+			FROM broadcast_recipients r
+			LEFT JOIN message_status s ON s.user_id = r.user_id AND s.chat_jid = r.jid AND s.message_id = r.message_id
+				AND s.participant_jid = ''
+			WHERE r.user_id = ? AND r.broadcast_id = ? GROUP BY r.status`, userID, id)
+	case "postgresql":
+		rows, err = db.Query(`SELECT r.status, COUNT(*),
+				SUM(CASE WHEN s.delivered_at > 0 OR s.read_at > 0 OR s.played_at > 0 THEN 1 ELSE 0 END),
+				SUM(CASE WHEN s.read_at > 0 OR s.played_at > 0 THEN 1 ELSE 0 END)
+			FROM broadcast_recipients r
+			LEFT JOIN message_status s ON s.user_id = r.user_id AND s.chat_jid = r.jid AND s.message_id = r.message_id
+				AND s.participant_jid = ''
+			WHERE r.user_id = $1 AND r.broadcast_id = $2 GROUP BY r.status`, userID, id)
+	default:
+		return stats, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count, delivered, read int
+		if err := rows.Scan(&status, &count, &delivered, &read); err != nil {
+			return stats, err
+		}
+		stats.Total += count
+		stats.Delivered += delivered
+		stats.Read += read
+		switch status {
+		case recipientPending, recipientSending:
+			stats.Pending += count
+		case recipientSent:
+			stats.Sent += count
+		case recipientFailed:
+			stats.Failed += count
+		case recipientInvalid:
+			stats.Invalid += count
+		case recipientCancelled:
+			stats.Cancelled += count
+		}
+	}
+	return stats, rows.Err()
+}
+
+// Returns the results of a broadcast for its recipients, in the order they
+// were given, optionally only those with the given status
+func listBroadcastRecipients(db *sql.DB, userID int, id string, status string, limit int, offset int) ([]broadcastRecipientResult, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT r.phone, r.jid, r.status, r.message_id, r.error, r.sent_at,
+				COALESCE(s.delivered_at, 0), COALESCE(s.read_at, 0), COALESCE(s.played_at, 0)
+			FROM broadcast_recipients r
+			LEFT JOIN message_status s ON s.user_id = r.user_id AND s.chat_jid = r.jid AND s.message_id = r.message_id
+				AND s.participant_jid = ''
+			WHERE r.user_id = ? AND r.broadcast_id = ? AND (? = '' OR r.status = ?)
+			ORDER BY r.position LIMIT ? OFFSET ?`, userID, id, status, status, limit, offset)
+	case "postgresql":
+		rows, err = db.Query(`SELECT r.phone, r.jid, r.status, r.message_id, r.error, r.sent_at,
+				COALESCE(s.delivered_at, 0), COALESCE(s.read_at, 0), COALESCE(s.played_at, 0)
+			FROM broadcast_recipients r
+			LEFT JOIN message_status s ON s.user_id = r.user_id AND s.chat_jid = r.jid AND s.message_id = r.message_id
+				AND s.participant_jid = ''
+			WHERE r.user_id = $1 AND r.broadcast_id = $2 AND ($3 = '' OR r.status = $3)
+			ORDER BY r.position LIMIT $4 OFFSET $5`, userID, id, status, limit, offset)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []broadcastRecipientResult{}
+	for rows.Next() {
+		var result broadcastRecipientResult
+		var sentAt, deliveredAt, readAt, playedAt int64
+		if err := rows.Scan(&result.Phone, &result.Jid, &result.Status, &result.MessageId, &result.Error, &sentAt,
+			&deliveredAt, &readAt, &playedAt); err != nil {
+			return nil, err
+		}
+		// Played voice notes and videos were read too
+		if readAt == 0 {
+			readAt = playedAt
+		}
+		if deliveredAt == 0 {
+			deliveredAt = readAt
+		}
+		result.SentAt = optUnixMilli(sentAt)
+		result.DeliveredAt = optUnixMilli(deliveredAt)
+		result.ReadAt = optUnixMilli(readAt)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// Moves a broadcast from one of the given states to another. Cancelling a
+// broadcast also cancels its pending recipients.
+func setBroadcastStatus(db *sql.DB, userID int, id string, from []string, to string) error {
+	job, err := getBroadcast(db, userID, id)
+	if err != nil {
+		return err
+	}
+	allowed := false
+	for _, status := range from {
+		allowed = allowed || job.Status == status
+	}
+	if !allowed {
+		switch {
+		case job.Status == broadcastCompleted || job.Status == broadcastCancelled:
+			return errBroadcastFinished
+		case to == broadcastRunning:
+			return errBroadcastNotPaused
+		default:
+			return errBroadcastNotRunning
+		}
+	}
+
+	finishedAt := int64(0)
+	if to == broadcastCompleted || to == broadcastCancelled {
+		finishedAt = time.Now().UnixMilli()
+	}
+	var jobStmt, recipientStmt string
+	switch dbType {
+	case "sqlite3":
+		jobStmt = `UPDATE broadcasts SET status = ?, finished_at = ? WHERE user_id = ? AND broadcast_id = ? AND status = ?`
+		recipientStmt = `UPDATE broadcast_recipients SET status = ? WHERE user_id = ? AND broadcast_id = ? AND status = ?`
+	case "postgresql":
+		jobStmt = `UPDATE broadcasts SET status = $1, finished_at = $2 WHERE user_id = $3 AND broadcast_id = $4 AND status = $5`
+		recipientStmt = `UPDATE broadcast_recipients SET status = $1 WHERE user_id = $2 AND broadcast_id = $3 AND status = $4`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(jobStmt, to, finishedAt, userID, id, job.Status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("broadcast changed while updating it, try again")
+	}
+	if to == broadcastCancelled {
+		if _, err := tx.Exec(recipientStmt, recipientCancelled, userID, id, recipientPending); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the oldest running broadcast of a user, nil if there is none
+func nextRunningBroadcast(db *sql.DB, userID int) (*broadcastJob, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = ? AND status = ? ORDER BY created_at LIMIT 1`, userID, broadcastRunning)
+	case "postgresql":
+		row = db.QueryRow(`SELECT broadcast_id, name, body, status, per_minute, jitter_seconds, typing, created_at, finished_at
+			FROM broadcasts WHERE user_id = $1 AND status = $2 ORDER BY created_at LIMIT 1`, userID, broadcastRunning)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	job, err := scanBroadcast(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// Pending recipient of a running broadcast
+type pendingRecipient struct {
+	Position  int
+	Phone     string
+	Jid       string
+	Variables map[string]string
+}
+
+// Returns up to limit pending recipients of a broadcast in order
+func pendingBroadcastRecipients(db *sql.DB, userID int, id string, limit int) ([]pendingRecipient, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT position, phone, jid, variables FROM broadcast_recipients
+			WHERE user_id = ? AND broadcast_id = ? AND status = ? ORDER BY position LIMIT ?`, userID, id, recipientPending, limit)
+	case "postgresql":
+		rows, err = db.Query(`SELECT position, phone, jid, variables FROM broadcast_recipients
+			WHERE user_id = $1 AND broadcast_id = $2 AND status = $3 ORDER BY position LIMIT $4`, userID, id, recipientPending, limit)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []pendingRecipient
+	for rows.Next() {
+		var recipient pendingRecipient
+		var variables string
+		if err := rows.Scan(&recipient.Position, &recipient.Phone, &recipient.Jid, &variables); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(variables), &recipient.Variables); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, rows.Err()
+}
+
+// Sets the WhatsApp JID of a checked recipient
+func setRecipientJID(db *sql.DB, userID int, id string, position int, jid types.JID) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE broadcast_recipients SET jid = ? WHERE user_id = ? AND broadcast_id = ? AND position = ?`,
+			jid.String(), userID, id, position)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE broadcast_recipients SET jid = $1 WHERE user_id = $2 AND broadcast_id = $3 AND position = $4`,
+			jid.String(), userID, id, position)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Moves a recipient from one state to another, recording the message sent
+// to it. Fails if the recipient is not in the expected state anymore.
+func setRecipientStatus(db *sql.DB, userID int, id string, position int, from string, to string, messageID string, errText string, sentAt time.Time) error {
+	var res sql.Result
+	var err error
+	switch dbType {
+	case "sqlite3":
+		res, err = db.Exec(`UPDATE broadcast_recipients SET status = ?, message_id = ?, error = ?, sent_at = ?
+			WHERE user_id = ? AND broadcast_id = ? AND position = ? AND status = ?`,
+			to, messageID, errText, unixMilliOrZero(sentAt), userID, id, position, from)
+	case "postgresql":
+		res, err = db.Exec(`UPDATE broadcast_recipients SET status = $1, message_id = $2, error = $3, sent_at = $4
+			WHERE user_id = $5 AND broadcast_id = $6 AND position = $7 AND status = $8`,
+			to, messageID, errText, unixMilliOrZero(sentAt), userID, id, position, from)
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("broadcast recipient is not %s", from)
+	}
+	return nil
+}
+
+// Counts the broadcast messages a user sent since the given time
+func countBroadcastSends(db *sql.DB, userID int, since time.Time) (int, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT COUNT(*) FROM broadcast_recipients WHERE user_id = ? AND status = ? AND sent_at >= ?`,
+			userID, recipientSent, since.UnixMilli())
+	case "postgresql":
+		row = db.QueryRow(`SELECT COUNT(*) FROM broadcast_recipients WHERE user_id = $1 AND status = $2 AND sent_at >= $3`,
+			userID, recipientSent, since.UnixMilli())
+	default:
+		return 0, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var count int
+	err := row.Scan(&count)
+	return count, err
+}
+
+// Marks recipients left being sent to by a previous run as failed, as the
+// messages may or may not have gone out
+func failInterruptedBroadcastSends(db *sql.DB, userID int) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE broadcast_recipients SET status = ?, error = ? WHERE user_id = ? AND status = ?`,
+			recipientFailed, "interrupted while sending", userID, recipientSending)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE broadcast_recipients SET status = $1, error = $2 WHERE user_id = $3 AND status = $4`,
+			recipientFailed, "interrupted while sending", userID, recipientSending)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Runs the broadcasts of a session one at a time, oldest first, until stop
+// is closed. Each one is paced with its own PerMinute and JitterSeconds,
+// taking turns with the send queue, and counts towards its daily cap.
+func (s *server) runBroadcasts(mycli *MyClient, stop <-chan struct{}) {
+	userID := mycli.userID
+	if err := failInterruptedBroadcastSends(s.db, userID); err != nil {
+		log.Error().Err(err).Msg("Failed to fail interrupted broadcast sends")
+	}
+
+	// Failed number checks are retried later and later, without holding up
+	// the send queue
+	var checkRetry time.Time
+	var checkBackoff time.Duration
+
+	ticker := time.NewTicker(broadcastPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		client := mycli.WAClient
+		if time.Now().Before(checkRetry) || !client.IsConnected() || client.Store.ID == nil {
+			continue
+		}
+		mycli.sendGate.run(func() time.Time {
+			next, err := s.sendNextBroadcast(mycli)
+			if err != nil {
+				checkBackoff = min(max(2*checkBackoff, minBroadcastCheckBackoff), maxBroadcastCheckBackoff)
+				checkRetry = time.Now().Add(checkBackoff)
+				log.Error().Err(err).Dur("retryIn", checkBackoff).Msg("Failed to check broadcast recipients")
+			} else {
+				checkBackoff = 0
+			}
+			return next
+		})
+	}
+}
+
+// Moves the oldest running broadcast of a session one step forward, and
+// returns when the next send can happen. Only failures to check the numbers
+// of recipients are returned, other errors are logged.
+func (s *server) sendNextBroadcast(mycli *MyClient) (time.Time, error) {
+	userID := mycli.userID
+	job, err := nextRunningBroadcast(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get next broadcast")
+		return time.Time{}, nil
+	}
+	if job == nil {
+		return time.Time{}, nil
+	}
+	recipients, err := pendingBroadcastRecipients(s.db, userID, job.Id, broadcastCheckBatchSize)
+	if err != nil {
+		log.Error().Err(err).Str("id", job.Id).Msg("Failed to get broadcast recipients")
+		return time.Time{}, nil
+	}
+	if len(recipients) == 0 {
+		if err := setBroadcastStatus(s.db, userID, job.Id, []string{broadcastRunning}, broadcastCompleted); err != nil {
+			log.Error().Err(err).Str("id", job.Id).Msg("Failed to complete broadcast")
+		} else {
+			log.Info().Str("id", job.Id).Msg("Broadcast completed")
+		}
+		return time.Time{}, nil
+	}
+
+	// Numbers are checked in batches ahead of sending to them
+	if recipients[0].Jid == "" {
+		if err := s.checkBroadcastRecipients(mycli.WAClient, userID, job.Id, recipients); err != nil {
+			return time.Time{}, fmt.Errorf("broadcast %s: %w", job.Id, err)
+		}
+		return time.Time{}, nil
+	}
+
+	settings, err := getQueueSettings(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get queue settings")
+		return time.Time{}, nil
+	}
+	if reset, err := dailyCapReset(s.db, userID, settings); err != nil {
+		log.Error().Err(err).Msg("Failed to count sends")
+		return time.Time{}, nil
+	} else if !reset.IsZero() {
+		return reset, nil
+	}
+
+	s.sendBroadcastMessage(mycli, job, recipients[0])
+	pacing := queueSettings{PerMinute: job.PerMinute, JitterSeconds: job.JitterSeconds}
+	return time.Now().Add(pacing.delay()), nil
+}
+
+// Looks up which recipients are on WhatsApp, as CheckUser does. Those that
+// are not are marked invalid and skipped.
+func (s *server) checkBroadcastRecipients(client *whatsmeow.Client, userID int, id string, recipients []pendingRecipient) error {
+	var phones []string
+	for _, recipient := range recipients {
+		if recipient.Jid == "" {
+			phones = append(phones, "+"+recipient.Phone)
+		}
+	}
+	resp, err := client.IsOnWhatsApp(phones)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]types.IsOnWhatsAppResponse, len(resp))
+	for _, item := range resp {
+		found[normalizePhone(item.Query)] = item
+	}
+
+	for _, recipient := range recipients {
+		if recipient.Jid != "" {
+			continue
+		}
+		if item, ok := found[recipient.Phone]; ok && item.IsIn {
+			err = setRecipientJID(s.db, userID, id, recipient.Position, item.JID)
+		} else {
+			err = setRecipientStatus(s.db, userID, id, recipient.Position, recipientPending, recipientInvalid, "", "not on WhatsApp", time.Time{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends the message of a broadcast to one recipient and records the result
+func (s *server) sendBroadcastMessage(mycli *MyClient, job *broadcastJob, recipient pendingRecipient) {
+	userID := mycli.userID
+	if err := setRecipientStatus(s.db, userID, job.Id, recipient.Position, recipientPending, recipientSending, "", "", time.Time{}); err != nil {
+		// Cancelled in the meantime
+		return
+	}
+
+	msgid := mycli.WAClient.GenerateMessageID()
+	var resp whatsmeow.SendResponse
+	chat, err := types.ParseJID(recipient.Jid)
+	var text string
+	if err == nil {
+		var tmpl *template.Template
+		if tmpl, err = parseMessageTemplate(job.Body); err == nil {
+			text, err = renderMessageTemplate(tmpl, recipient.Variables)
+		}
+	}
+	if err == nil {
+		msg := &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(text)}}
+		if job.Typing {
+			simulateTyping(mycli.WAClient, chat, msg)
+		}
+		resp, err = s.sendMessage(context.Background(), userID, chat, msg, msgid)
+	}
+
+	status, errText := recipientSent, ""
+	if err != nil {
+		status, errText = recipientFailed, err.Error()
+		log.Error().Err(err).Str("id", job.Id).Str("phone", recipient.Phone).Msg("Failed to send broadcast message")
+	} else {
+		log.Info().Str("id", job.Id).Str("phone", recipient.Phone).Str("message", msgid).Msg("Broadcast message sent")
+	}
+	if err := setRecipientStatus(s.db, userID, job.Id, recipient.Position, recipientSending, status, msgid, errText, resp.Timestamp); err != nil {
+		log.Error().Err(err).Str("id", job.Id).Msg("Failed to update broadcast recipient")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Page sizes of the chat list
+const (
+	defaultChatsLimit = 100
+	maxChatsLimit     = 500
+)
+
+// Chats muted forever have this mute end time
+const mutedForever = -1
+
+// Filters of the chat list
+type chatFilter struct {
+	Groups     bool
+	Direct     bool
+	UnreadOnly bool
+	Limit      int
+	Offset     int
+}
+
+// Preview of the last known message of a chat
+type chatLastMessage struct {
+	Id        string
+	Sender    string
+	FromMe    bool
+	Type      string
+	Body      string
+	Timestamp time.Time
+}
+
+// Chat as returned by the chat list
+type chatSummary struct {
+	Jid               string
+	Name              string
+	IsGroup           bool
+	UnreadCount       int
+	Archived          bool
+	Pinned            bool
+	Muted             bool
+	MutedUntil        *time.Time `json:",omitempty"`
+	DisappearingTimer uint32
+	LastMessageAt     *time.Time       `json:",omitempty"`
+	LastMessage       *chatLastMessage `json:",omitempty"`
+}
+
+// Returns the chats of a user, pinned first and then by the time of their
+// last message. Status broadcasts are not chats and are left out.
+func listChats(db *sql.DB, userID int, filter chatFilter) ([]chatSummary, error) {
+	conditions := ""
+	if filter.Groups && !filter.Direct {
+		conditions += ` AND c.chat_jid LIKE '%@g.us'`
+	} else if filter.Direct && !filter.Groups {
+		conditions += ` AND c.chat_jid NOT LIKE '%@g.us'`
+	}
+	if filter.UnreadOnly {
+		conditions += ` AND c.unread_count > 0`
+	}
+
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT c.chat_jid, c.name, c.unread_count, c.last_message_at, c.archived, c.pinned, c.muted_until,
+				COALESCE(s.disappearing_timer, 0)
+			FROM chats c LEFT JOIN chat_settings s ON s.user_id = c.user_id AND s.chat_jid = c.chat_jid
+			WHERE c.user_id = ? AND c.chat_jid NOT LIKE '%@broadcast'`+conditions+`
+			ORDER BY c.pinned DESC, c.last_message_at DESC, c.chat_jid LIMIT ? OFFSET ?`,
+			userID, filter.Limit, filter.Offset)
+	case "postgresql":
+		rows, err = db.Query(`SELECT c.chat_jid, c.name, c.unread_count, c.last_message_at, c.archived, c.pinned, c.muted_until,
+				COALESCE(s.disappearing_timer, 0)
+			FROM chats c LEFT JOIN chat_settings s ON s.user_id = c.user_id AND s.chat_jid = c.chat_jid
+			WHERE c.user_id = $1 AND c.chat_jid NOT LIKE '%@broadcast'`+conditions+`
+			ORDER BY c.pinned DESC, c.last_message_at DESC, c.chat_jid LIMIT $2 OFFSET $3`,
+			userID, filter.Limit, filter.Offset)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []chatSummary{}
+	now := time.Now().Unix()
+	for rows.Next() {
+		var chat chatSummary
+		var lastMessageAt, mutedUntil int64
+		if err := rows.Scan(&chat.Jid, &chat.Name, &chat.UnreadCount, &lastMessageAt, &chat.Archived, &chat.Pinned, &mutedUntil,
+			&chat.DisappearingTimer); err != nil {
+			return nil, err
+		}
+		if lastMessageAt > 0 {
+			t := time.Unix(lastMessageAt, 0)
+			chat.LastMessageAt = &t
+		}
+		chat.Muted = mutedUntil == mutedForever || mutedUntil > now
+		if mutedUntil > now {
+			t := time.Unix(mutedUntil, 0)
+			chat.MutedUntil = &t
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range chats {
+		jid, err := types.ParseJID(chats[i].Jid)
+		if err != nil {
+			continue
+		}
+		chats[i].IsGroup = jid.Server == types.GroupServer
+		last, err := getLatestIndexedMessage(db, userID, jid)
+		if errors.Is(err, errMessageNotIndexed) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		chats[i].LastMessage = &chatLastMessage{
+			Id:        last.ID,
+			Sender:    last.Sender.String(),
+			FromMe:    last.FromMe,
+			Type:      messageType(last.Message),
+			Body:      messageBody(last.Message),
+			Timestamp: last.Timestamp,
+		}
+	}
+	return chats, nil
+}
+
+// Fills in the names of chats. Direct chats are named after the contact,
+// groups after their subject, which is fetched from WhatsApp when unknown.
+func resolveChatNames(client *whatsmeow.Client, db *sql.DB, userID int, chats []chatSummary) {
+	var groups map[string]string
+	for i := range chats {
+		chat := &chats[i]
+		jid, err := types.ParseJID(chat.Jid)
+		if err != nil {
+			continue
+		}
+
+		if !chat.IsGroup {
+			contact, err := client.Store.Contacts.GetContact(jid)
+			if err != nil || !contact.Found {
+				continue
+			}
+			for _, name := range []string{contact.FullName, chat.Name, contact.FirstName, contact.BusinessName, contact.PushName} {
+				if name != "" {
+					chat.Name = name
+					break
+				}
+			}
+			continue
+		}
+
+		if chat.Name != "" || !client.IsConnected() {
+			continue
+		}
+		if groups == nil {
+			groups = make(map[string]string)
+			joined, err := client.GetJoinedGroups()
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to get joined groups for chat names")
+			}
+			for _, group := range joined {
+				groups[group.JID.String()] = group.Name
+			}
+		}
+		if name := groups[chat.Jid]; name != "" {
+			chat.Name = name
+			if err := setChatName(db, userID, jid, name); err != nil {
+				log.Warn().Err(err).Str("chat", chat.Jid).Msg("Failed to save chat name")
+			}
+		}
+	}
+}
+
+// Updates a single property of a chat, recording the chat if it is new.
+// Column must be one of the constant names used below.
+func updateChat(db *sql.DB, userID int, chat types.JID, column string, value interface{}) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, ` + column + `) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET ` + column + ` = excluded.` + column
+	case "postgresql":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, ` + column + `) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET ` + column + ` = excluded.` + column
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.ToNonAD().String(), value)
+	return err
+}
+
+func setChatName(db *sql.DB, userID int, chat types.JID, name string) error {
+	return updateChat(db, userID, chat, "name", name)
+}
+
+func setChatArchived(db *sql.DB, userID int, chat types.JID, archived bool) error {
+	return updateChat(db, userID, chat, "archived", archived)
+}
+
+func setChatPinned(db *sql.DB, userID int, chat types.JID, pinned bool) error {
+	return updateChat(db, userID, chat, "pinned", pinned)
+}
+
+// Records until when a chat is muted, as a unix time, 0 when it is not
+// muted and mutedForever when it is muted with no end
+func setChatMutedUntil(db *sql.DB, userID int, chat types.JID, until int64) error {
+	return updateChat(db, userID, chat, "muted_until", until)
+}
+
+// Clears the unread count of a chat, or flags it as unread the way the
+// phone does when a chat is marked as unread
+func markChatRead(db *sql.DB, userID int, chat types.JID, read bool) error {
+	if read {
+		return updateChat(db, userID, chat, "unread_count", 0)
+	}
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, unread_count) VALUES (?, ?, 1)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET unread_count = MAX(chats.unread_count, 1)`
+	case "postgresql":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, unread_count) VALUES ($1, $2, 1)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET unread_count = GREATEST(chats.unread_count, 1)`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.ToNonAD().String())
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name  string
+		expr  string
+		loc   *time.Location
+		after string
+		want  []string
+	}{
+		{
+			name:  "every minute",
+			expr:  "* * * * *",
+			after: "2024-04-01T10:00:30Z",
+			want:  []string{"2024-04-01T10:01:00Z", "2024-04-01T10:02:00Z"},
+		},
+		{
+			name:  "minute step",
+			expr:  "*/15 * * * *",
+			after: "2024-04-01T10:00:00Z",
+			want:  []string{"2024-04-01T10:15:00Z", "2024-04-01T10:30:00Z", "2024-04-01T10:45:00Z", "2024-04-01T11:00:00Z"},
+		},
+		{
+			name:  "step within a range",
+			expr:  "0 8-17/4 * * *",
+			after: "2024-04-01T09:00:00Z",
+			want:  []string{"2024-04-01T12:00:00Z", "2024-04-01T16:00:00Z", "2024-04-02T08:00:00Z"},
+		},
+		{
+			name:  "value with a step",
+			expr:  "5/20 * * * *",
+			after: "2024-04-01T10:00:00Z",
+			want:  []string{"2024-04-01T10:05:00Z", "2024-04-01T10:25:00Z", "2024-04-01T10:45:00Z", "2024-04-01T11:05:00Z"},
+		},
+		{
+			name:  "list",
+			expr:  "0 9,13 * * *",
+			after: "2024-04-01T10:00:00Z",
+			want:  []string{"2024-04-01T13:00:00Z", "2024-04-02T09:00:00Z"},
+		},
+		{
+			name:  "named week days",
+			expr:  "30 9 * * mon-fri",
+			after: "2024-04-05T10:00:00Z", // a Friday
+			want:  []string{"2024-04-08T09:30:00Z", "2024-04-09T09:30:00Z"},
+		},
+		{
+			name:  "named months",
+			expr:  "0 0 1 JAN,jul *",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-07-01T00:00:00Z", "2025-01-01T00:00:00Z"},
+		},
+		{
+			name:  "Sunday as 7",
+			expr:  "0 12 * * 7",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-07T12:00:00Z", "2024-04-14T12:00:00Z"},
+		},
+		{
+			name:  "Sunday as 0",
+			expr:  "0 12 * * 0",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-07T12:00:00Z"},
+		},
+		{
+			name:  "range ending on Sunday as 7",
+			expr:  "0 12 * * 6-7",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-06T12:00:00Z", "2024-04-07T12:00:00Z", "2024-04-13T12:00:00Z"},
+		},
+		{
+			name:  "day of month or day of week",
+			expr:  "0 0 13 * 5",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-05T00:00:00Z", "2024-04-12T00:00:00Z", "2024-04-13T00:00:00Z", "2024-04-19T00:00:00Z"},
+		},
+		{
+			name:  "day of month with any week day",
+			expr:  "0 0 13 * *",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-13T00:00:00Z", "2024-05-13T00:00:00Z"},
+		},
+		{
+			// As in Vixie cron, a field starting with * counts as unrestricted
+			name:  "week day with stepped day of month",
+			expr:  "0 0 */10 * 1",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-07-01T00:00:00Z", "2024-10-21T00:00:00Z"},
+		},
+		{
+			name:  "leap day",
+			expr:  "0 0 29 2 *",
+			after: "2024-03-01T00:00:00Z",
+			want:  []string{"2028-02-29T00:00:00Z"},
+		},
+		{
+			name:  "macro",
+			expr:  "@weekly",
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-07T00:00:00Z", "2024-04-14T00:00:00Z"},
+		},
+		{
+			name:  "time zone",
+			expr:  "0 9 * * *",
+			loc:   newYork,
+			after: "2024-04-01T00:00:00Z",
+			want:  []string{"2024-04-01T13:00:00Z", "2024-04-02T13:00:00Z"},
+		},
+		{
+			name:  "daylight saving starts",
+			expr:  "0 9 * * *",
+			loc:   newYork,
+			after: "2024-03-09T12:00:00Z",
+			want:  []string{"2024-03-09T14:00:00Z", "2024-03-10T13:00:00Z"},
+		},
+		{
+			name:  "skipped hour",
+			expr:  "30 2 * * *",
+			loc:   newYork,
+			after: "2024-03-09T12:00:00Z",
+			want:  []string{"2024-03-11T06:30:00Z"},
+		},
+		{
+			name:  "repeated hour runs once",
+			expr:  "30 1 * * *",
+			loc:   newYork,
+			after: "2024-11-03T04:00:00Z",
+			want:  []string{"2024-11-03T05:30:00Z", "2024-11-04T06:30:00Z"},
+		},
+		{
+			name:  "every minute through repeated hour",
+			expr:  "*/30 1 * * *",
+			loc:   newYork,
+			after: "2024-11-03T05:15:00Z",
+			want:  []string{"2024-11-03T05:30:00Z", "2024-11-04T06:00:00Z"},
+		},
+		{
+			name:  "no match",
+			expr:  "0 0 31 2 *",
+			after: "2024-01-01T00:00:00Z",
+			want:  []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			c, err := parseCron(tt.expr, loc)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.expr, err)
+			}
+			after := utc(tt.after)
+			for _, want := range tt.want {
+				got := c.next(after)
+				if want == "" {
+					if !got.IsZero() {
+						t.Fatalf("next(%v) = %v, want none", after, got)
+					}
+					return
+				}
+				if !got.Equal(utc(want)) {
+					t.Fatalf("next(%v) = %v, want %s", after, got.UTC(), want)
+				}
+				after = got
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * FOO *",
+		"* * * * MON-",
+		"@every 5m",
+	}
+
+	for _, expr := range tests {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) accepted invalid expression", expr)
+		}
+	}
+}
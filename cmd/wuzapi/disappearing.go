@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Records the disappearing messages timer of a chat, in seconds. Zero means
+// disappearing messages are off.
+func saveDisappearingTimer(db *sql.DB, userID int, chat types.JID, seconds uint32) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO chat_settings (user_id, chat_jid, disappearing_timer) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET disappearing_timer=excluded.disappearing_timer`
+	case "postgresql":
+		sqlStmt = `INSERT INTO chat_settings (user_id, chat_jid, disappearing_timer) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET disappearing_timer=excluded.disappearing_timer`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.ToNonAD().String(), seconds)
+	return err
+}
+
+// Returns the known disappearing messages timer of a chat, zero if it is off
+// or unknown
+func getDisappearingTimer(db *sql.DB, userID int, chat types.JID) (uint32, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT disappearing_timer FROM chat_settings WHERE user_id = ? AND chat_jid = ?`, userID, chat.ToNonAD().String())
+	case "postgresql":
+		row = db.QueryRow(`SELECT disappearing_timer FROM chat_settings WHERE user_id = $1 AND chat_jid = $2`, userID, chat.ToNonAD().String())
+	default:
+		return 0, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var seconds uint32
+	err := row.Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return seconds, err
+}
+
+// Makes an outgoing message disappear after the given number of seconds, as
+// recipients expect for messages sent to chats with a timer
+func setExpiration(msg *waProto.Message, seconds uint32) {
+	ci := getContextInfo(msg)
+	if ci == nil {
+		ci = &waProto.ContextInfo{}
+		setContextInfo(msg, ci)
+	}
+	ci.Expiration = proto.Uint32(seconds)
+}
+
+// Returns the disappearing timer of a group, zero if it is off
+func groupDisappearingTimer(ephemeral types.GroupEphemeral) uint32 {
+	if !ephemeral.IsEphemeral {
+		return 0
+	}
+	return ephemeral.DisappearingTimer
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/socket"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
+)
+
+// Length of the truncated HMAC appended to encrypted media
+const mediaMACLength = 10
+
+const (
+	// Attempts on each CDN URL when the connection fails, before moving on to
+	// the next one
+	mediaCDNAttempts = 3
+	// How long the CDN may take to answer a request or to send more of the
+	// media before the attempt is given up
+	mediaCDNStallTimeout = 30 * time.Second
+)
+
+var errMediaStalled = errors.New("media download stalled")
+
+// Client for the WhatsApp media CDN. Downloads can be large, so there is no
+// overall timeout: slow responses are cut by mediaCDNStallTimeout instead.
+var mediaCDNClient = &http.Client{Transport: mediaCDNTransport()}
+
+func mediaCDNTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = mediaCDNStallTimeout
+	return transport
+}
+
+// App info of the media keys of each kind of downloadable message
+func downloadMediaType(msg whatsmeow.DownloadableMessage) (whatsmeow.MediaType, string, error) {
+	switch msg.ProtoReflect().Descriptor().Name() {
+	case "ImageMessage", "StickerMessage":
+		return whatsmeow.MediaImage, "image", nil
+	case "VideoMessage":
+		return whatsmeow.MediaVideo, "video", nil
+	case "AudioMessage":
+		return whatsmeow.MediaAudio, "audio", nil
+	case "DocumentMessage":
+		return whatsmeow.MediaDocument, "document", nil
+	}
+	return "", "", fmt.Errorf("%w '%s'", whatsmeow.ErrUnknownMediaType, msg.ProtoReflect().Descriptor().Name())
+}
+
+// URLs the media of a message can be fetched from, in the order whatsmeow
+// tries them: the message URL, else the direct path on each media host
+func mediaDownloadURLs(client *whatsmeow.Client, msg whatsmeow.DownloadableMessage) ([]string, error) {
+	_, mmsType, err := downloadMediaType(msg)
+	if err != nil {
+		return nil, err
+	}
+	if withURL, ok := msg.(interface{ GetUrl() string }); ok {
+		if url := withURL.GetUrl(); url != "" && !strings.HasPrefix(url, "https://web.whatsapp.net") {
+			return []string{url}, nil
+		}
+	}
+	if msg.GetDirectPath() == "" {
+		return nil, whatsmeow.ErrNoURLPresent
+	}
+
+	mediaConn, err := client.DangerousInternals().RefreshMediaConn(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh media connections: %w", err)
+	}
+	urls := make([]string, 0, len(mediaConn.Hosts))
+	for _, host := range mediaConn.Hosts {
+		urls = append(urls, fmt.Sprintf("https://%s%s&hash=%s&mms-type=%s&__wa-mms=", host.Hostname, msg.GetDirectPath(),
+			base64.URLEncoding.EncodeToString(msg.GetFileEncSha256()), mmsType))
+	}
+	return urls, nil
+}
+
+func mediaCDNRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Origin", socket.Origin)
+	req.Header.Set("Referer", socket.Origin+"/")
+	return req, nil
+}
+
+// Whether a failed CDN request is worth repeating on the same URL: the
+// connection broke or stalled, or the server failed
+func retryableMediaError(err error) bool {
+	var netErr net.Error
+	var httpErr whatsmeow.DownloadHTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode >= http.StatusInternalServerError
+	case errors.Is(err, errMediaStalled), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &netErr):
+		return true
+	}
+	return false
+}
+
+// Calls fetch on each URL in turn until one succeeds, retrying a URL a few
+// times when the connection fails. Returns the error of the last attempt.
+func tryMediaURLs(urls []string, fetch func(url string) error) error {
+	var err error
+	for i, url := range urls {
+		for attempt := 1; attempt <= mediaCDNAttempts; attempt++ {
+			err = fetch(url)
+			if err == nil || !retryableMediaError(err) {
+				break
+			}
+			if attempt < mediaCDNAttempts {
+				log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to fetch media, retrying")
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if i < len(urls)-1 {
+			log.Warn().Err(err).Msg("Failed to fetch media, trying with next host")
+		}
+	}
+	return err
+}
+
+// Reader of a CDN response body that cancels the request when no data
+// arrives for mediaCDNStallTimeout
+type stallReader struct {
+	body    io.Reader
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallReader(body io.Reader, cancel context.CancelFunc) *stallReader {
+	r := &stallReader{body: body}
+	r.timer = time.AfterFunc(mediaCDNStallTimeout, func() {
+		r.stalled.Store(true)
+		cancel()
+	})
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.stalled.Load() {
+		return n, errMediaStalled
+	}
+	r.timer.Reset(mediaCDNStallTimeout)
+	return n, err
+}
+
+func (r *stallReader) stop() {
+	r.timer.Stop()
+}
+
+// Checks whether the media of a message can still be fetched from the CDN,
+// asking for its first byte only. Expired media fails with the same 404 and
+// 410 errors as whatsmeow's Download.
+func probeMedia(client *whatsmeow.Client, msg whatsmeow.DownloadableMessage) error {
+	urls, err := mediaDownloadURLs(client, msg)
+	if err != nil {
+		return err
+	}
+	return tryMediaURLs(urls, probeMediaURL)
+}
+
+func probeMediaURL(url string) error {
+	req, err := mediaCDNRequest(context.Background(), http.MethodGet, url)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := mediaCDNClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return whatsmeow.DownloadHTTPError{Response: resp}
+	}
+	return nil
+}
+
+// Downloads and decrypts the media of a message into a file, without holding
+// it in memory. The file is left at the end of the media.
+func downloadToFile(client *whatsmeow.Client, msg whatsmeow.DownloadableMessage, file *os.File) error {
+	urls, err := mediaDownloadURLs(client, msg)
+	if err != nil {
+		return err
+	}
+	return tryMediaURLs(urls, func(url string) error {
+		return downloadURLToFile(url, msg, file)
+	})
+}
+
+func downloadURLToFile(url string, msg whatsmeow.DownloadableMessage, file *os.File) error {
+	appInfo, _, err := downloadMediaType(msg)
+	if err != nil {
+		return err
+	}
+	if err := resetFile(file); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := mediaCDNRequest(ctx, http.MethodGet, url)
+	if err != nil {
+		return err
+	}
+	resp, err := mediaCDNClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return whatsmeow.DownloadHTTPError{Response: resp}
+	}
+	body := newStallReader(resp.Body, cancel)
+	defer body.stop()
+
+	// Unencrypted media is stored as is
+	if len(msg.GetMediaKey()) == 0 {
+		_, err := io.Copy(file, body)
+		return err
+	}
+
+	encrypted, err := os.CreateTemp("", "wuzapi-media-*.enc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encrypted.Name())
+	defer encrypted.Close()
+
+	encHash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(encrypted, encHash), body)
+	if err != nil {
+		return fmt.Errorf("failed to download media: %w", err)
+	}
+	if size <= mediaMACLength || (size-mediaMACLength)%aes.BlockSize != 0 {
+		return whatsmeow.ErrTooShortFile
+	}
+	if want := msg.GetFileEncSha256(); len(want) == 32 && !bytes.Equal(encHash.Sum(nil), want) {
+		return whatsmeow.ErrInvalidMediaEncSHA256
+	}
+
+	keys := hkdfutil.SHA256(msg.GetMediaKey(), nil, []byte(appInfo), 112)
+	iv, cipherKey, macKey := keys[:16], keys[16:48], keys[48:80]
+	return decryptMediaFile(encrypted, size-mediaMACLength, iv, cipherKey, macKey, msg, file)
+}
+
+// Checks the MAC of encrypted media and decrypts it into file
+func decryptMediaFile(encrypted *os.File, length int64, iv, cipherKey, macKey []byte, msg whatsmeow.DownloadableMessage, file *os.File) error {
+	mac := make([]byte, mediaMACLength)
+	if _, err := encrypted.ReadAt(mac, length); err != nil {
+		return err
+	}
+	h := hmac.New(sha256.New, macKey)
+	h.Write(iv)
+	if _, err := io.Copy(h, io.NewSectionReader(encrypted, 0, length)); err != nil {
+		return err
+	}
+	if !hmac.Equal(h.Sum(nil)[:mediaMACLength], mac) {
+		return whatsmeow.ErrInvalidMediaHMAC
+	}
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return err
+	}
+	decrypter := cipher.NewCBCDecrypter(block, iv)
+	plainHash := sha256.New()
+	out := io.MultiWriter(file, plainHash)
+
+	reader := io.NewSectionReader(encrypted, 0, length)
+	buf := make([]byte, 64*1024)
+	var written int64
+	for remaining := length; remaining > 0; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return err
+		}
+		decrypter.CryptBlocks(chunk, chunk)
+		remaining -= n
+		// The last block carries the PKCS#7 padding
+		if remaining == 0 {
+			pad := int(chunk[len(chunk)-1])
+			if pad == 0 || pad > aes.BlockSize || pad > len(chunk) {
+				return errors.New("failed to decrypt file: invalid padding")
+			}
+			chunk = chunk[:len(chunk)-pad]
+		}
+		if _, err := out.Write(chunk); err != nil {
+			return err
+		}
+		written += int64(len(chunk))
+	}
+
+	if withLength, ok := msg.(interface{ GetFileLength() uint64 }); ok && withLength.GetFileLength() > 0 && uint64(written) != withLength.GetFileLength() {
+		return fmt.Errorf("%w: expected %d, got %d", whatsmeow.ErrFileLengthMismatch, withLength.GetFileLength(), written)
+	}
+	if want := msg.GetFileSha256(); len(want) == 32 && !bytes.Equal(plainHash.Sum(nil), want) {
+		return whatsmeow.ErrInvalidMediaSHA256
+	}
+	return nil
+}
+
+func resetFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
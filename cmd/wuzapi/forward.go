@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Rebuilds an indexed message as a forward, marked as such in its context
+func buildForward(im *indexedMessage) (*waProto.Message, error) {
+	orig := im.Message
+	switch {
+	case orig.GetProtocolMessage() != nil, orig.GetReactionMessage() != nil, orig.GetPollUpdateMessage() != nil:
+		return nil, errors.New("message can not be forwarded")
+	case getPollCreation(orig) != nil:
+		return nil, errors.New("polls can not be forwarded")
+	case orig.GetImageMessage().GetViewOnce(), orig.GetVideoMessage().GetViewOnce(), orig.GetAudioMessage().GetViewOnce():
+		return nil, errors.New("view once messages can not be forwarded")
+	case contentRemoved(orig):
+		return nil, errMessageContentGone
+	}
+
+	msg := proto.Clone(orig).(*waProto.Message)
+	msg.MessageContextInfo = nil
+	score := getContextInfo(orig).GetForwardingScore()
+	setContextInfo(msg, &waProto.ContextInfo{
+		IsForwarded:     proto.Bool(true),
+		ForwardingScore: proto.Uint32(score + 1),
+	})
+	if getContextInfo(msg) == nil {
+		return nil, errors.New("message can not be forwarded")
+	}
+	return msg, nil
+}
+
+// Makes sure the media of a forward can still be downloaded by the
+// recipients. If the copy on the WhatsApp CDN is gone, the media is fetched
+// again through the sender's phone and uploaded anew.
+func refreshForwardMedia(ctx context.Context, client *whatsmeow.Client, db *sql.DB, userID int, im *indexedMessage, msg *waProto.Message) error {
+	mediaType, downloadable := getDownloadable(msg)
+	if downloadable == nil {
+		return nil
+	}
+
+	// Only the first byte is requested, the media itself is not needed
+	err := probeMedia(client, downloadable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) && !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		return fmt.Errorf("failed to check media: %w", err)
+	}
+
+	data, err := downloadIndexedMedia(client, db, userID, im)
+	if err != nil {
+		return err
+	}
+	uploaded, err := client.Upload(ctx, data, uploadMediaType(mediaType))
+	if err != nil {
+		return fmt.Errorf("failed to upload media: %w", err)
+	}
+
+	setUploadedMedia(msg, uploaded, uint64(len(data)))
+	return nil
+}
+
+// Media type to upload the media of each kind of message with
+func uploadMediaType(mediaType string) whatsmeow.MediaType {
+	switch mediaType {
+	case "video":
+		return whatsmeow.MediaVideo
+	case "audio":
+		return whatsmeow.MediaAudio
+	case "document":
+		return whatsmeow.MediaDocument
+	}
+	return whatsmeow.MediaImage
+}
+
+// Points the media sub message of msg to a new upload
+func setUploadedMedia(msg *waProto.Message, uploaded whatsmeow.UploadResponse, length uint64) {
+	url, directPath := proto.String(uploaded.URL), proto.String(uploaded.DirectPath)
+	switch {
+	case msg.ImageMessage != nil:
+		m := msg.ImageMessage
+		m.Url, m.DirectPath, m.MediaKey, m.FileEncSha256, m.FileSha256, m.FileLength = url, directPath, uploaded.MediaKey, uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(length)
+	case msg.VideoMessage != nil:
+		m := msg.VideoMessage
+		m.Url, m.DirectPath, m.MediaKey, m.FileEncSha256, m.FileSha256, m.FileLength = url, directPath, uploaded.MediaKey, uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(length)
+	case msg.AudioMessage != nil:
+		m := msg.AudioMessage
+		m.Url, m.DirectPath, m.MediaKey, m.FileEncSha256, m.FileSha256, m.FileLength = url, directPath, uploaded.MediaKey, uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(length)
+	case msg.DocumentMessage != nil:
+		m := msg.DocumentMessage
+		m.Url, m.DirectPath, m.MediaKey, m.FileEncSha256, m.FileSha256, m.FileLength = url, directPath, uploaded.MediaKey, uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(length)
+	case msg.StickerMessage != nil:
+		m := msg.StickerMessage
+		m.Url, m.DirectPath, m.MediaKey, m.FileEncSha256, m.FileSha256, m.FileLength = url, directPath, uploaded.MediaKey, uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(length)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,7 +33,7 @@ func (v Values) Get(key string) string {
 	return v.m[key]
 }
 
-var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "MessageEdit", "MessageRevoke", "PollVote", "LocationUpdate", "MessageStatus", "SendResult", "ScheduledSend", "All"}
 
 func (s *server) authadmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -665,18 +668,16 @@ func (s *server) SendDocument() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientPointer[userid] == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t documentStruct
-		err := decoder.Decode(&t)
+		upload, err := decodePayload(w, r, &t, "Document")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
 			return
 		}
 
@@ -685,12 +686,12 @@ func (s *server) SendDocument() http.HandlerFunc {
 			return
 		}
 
-		if t.Document == "" {
+		if t.Document == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Document in Payload"))
 			return
 		}
 
-		if t.FileName == "" {
+		if t.FileName == "" && (upload == nil || upload.FileName == "") {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing FileName in Payload"))
 			return
 		}
@@ -711,21 +712,20 @@ func (s *server) SendDocument() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Document[0:29] == "data:application/octet-stream" {
-			dataURL, err := dataurl.DecodeString(t.Document)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file:%s", err))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("document data should start with \"data:application/octet-stream;base64,\""))
+		media, err := getMedia(r, upload, t.Document)
+		if err != nil {
+			s.respondMediaError(w, r, err, err)
+			return
+		}
+
+		if t.FileName == "" {
+			t.FileName = media.FileName
+		}
+
+		filedata = media.Data
+		uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file:%s", err))
 			return
 		}
 
@@ -734,29 +734,27 @@ func (s *server) SendDocument() http.HandlerFunc {
 			FileName:      &t.FileName,
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      proto.String(media.Mimetype),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
 			Caption:       proto.String(t.Caption),
 		}}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Caption)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -774,6 +772,8 @@ func (s *server) SendAudio() http.HandlerFunc {
 		Audio       string
 		Caption     string
 		Id          string
+		PTT         *bool
+		ViewOnce    bool
 		ContextInfo waProto.ContextInfo
 	}
 
@@ -782,18 +782,16 @@ func (s *server) SendAudio() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientPointer[userid] == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t audioStruct
-		err := decoder.Decode(&t)
+		upload, err := decodePayload(w, r, &t, "Audio")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
 			return
 		}
 
@@ -802,7 +800,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 			return
 		}
 
-		if t.Audio == "" {
+		if t.Audio == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Audio in Payload"))
 			return
 		}
@@ -823,54 +821,75 @@ func (s *server) SendAudio() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Audio[0:14] == "data:audio/ogg" {
-			dataURL, err := dataurl.DecodeString(t.Audio)
+		media, err := getMedia(r, upload, t.Audio)
+		if err != nil {
+			s.respondMediaError(w, r, err, err)
+			return
+		}
+
+		// Voice notes are only played back when they are Ogg/Opus, regular
+		// audio messages can be any format supported by WhatsApp
+		ptt := true
+		if t.PTT != nil {
+			ptt = *t.PTT
+		}
+		mimetype := media.Mimetype
+		var opus *opusMeta
+		if bytes.HasPrefix(media.Data, []byte("OggS")) {
+			opus, err = getOpusMeta(media.Data)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
-					return
-				}
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("audio data should start with \"data:audio/ogg;base64,\""))
+			mimetype = "audio/ogg; codecs=opus"
+		} else if ptt {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("voice notes must be Ogg/Opus audio, got %s", media.Mimetype))
+			return
+		} else if !strings.HasPrefix(media.Mimetype, "audio/") {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported audio type %s", media.Mimetype))
 			return
 		}
 
-		ptt := true
-		mime := "audio/ogg; codecs=opus"
+		filedata = media.Data
+		uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
+			return
+		}
 
 		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
 			Url:        proto.String(uploaded.URL),
 			DirectPath: proto.String(uploaded.DirectPath),
 			MediaKey:   uploaded.MediaKey,
 			//Mimetype:      proto.String(http.DetectContentType(filedata)),
-			Mimetype:      &mime,
+			Mimetype:      proto.String(mimetype),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
 			Ptt:           &ptt,
 		}}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		if opus != nil {
+			msg.AudioMessage.Seconds = proto.Uint32(opus.Seconds)
+			msg.AudioMessage.Waveform = opus.Waveform
+		}
+
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, "")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setContextInfo(msg, contextInfo)
+		if t.ViewOnce {
+			msg = wrapViewOnce(msg)
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -888,6 +907,7 @@ func (s *server) SendImage() http.HandlerFunc {
 		Image       string
 		Caption     string
 		Id          string
+		ViewOnce    bool
 		ContextInfo waProto.ContextInfo
 	}
 
@@ -896,18 +916,16 @@ func (s *server) SendImage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientPointer[userid] == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
+		upload, err := decodePayload(w, r, &t, "Image")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
 			return
 		}
 
@@ -916,7 +934,7 @@ func (s *server) SendImage() http.HandlerFunc {
 			return
 		}
 
-		if t.Image == "" {
+		if t.Image == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Image in Payload"))
 			return
 		}
@@ -937,21 +955,20 @@ func (s *server) SendImage() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Image[0:10] == "data:image" {
-			dataURL, err := dataurl.DecodeString(t.Image)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("image data should start with \"data:image/png;base64,\""))
+		media, err := getMedia(r, upload, t.Image)
+		if err != nil {
+			s.respondMediaError(w, r, err, err)
+			return
+		}
+		if !strings.HasPrefix(media.Mimetype, "image/") {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported image type %s", media.Mimetype))
+			return
+		}
+
+		filedata = media.Data
+		uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
 			return
 		}
 
@@ -960,28 +977,37 @@ func (s *server) SendImage() http.HandlerFunc {
 			Url:           proto.String(uploaded.URL),
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      proto.String(media.Mimetype),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
 		}}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		if meta, err := getImageMeta(filedata); err != nil {
+			log.Warn().Err(err).Str("id", msgid).Msg("Could not generate image thumbnail")
+		} else {
+			msg.ImageMessage.Width = proto.Uint32(meta.Width)
+			msg.ImageMessage.Height = proto.Uint32(meta.Height)
+			msg.ImageMessage.JpegThumbnail = meta.Thumbnail
+		}
+
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Caption)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setContextInfo(msg, contextInfo)
+		if t.ViewOnce {
+			msg = wrapViewOnce(msg)
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -999,6 +1025,9 @@ func (s *server) SendSticker() http.HandlerFunc {
 		Sticker      string
 		Id           string
 		PngThumbnail []byte
+		PackName     string
+		PackAuthor   string
+		Emojis       []string
 		ContextInfo  waProto.ContextInfo
 	}
 
@@ -1007,18 +1036,16 @@ func (s *server) SendSticker() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientPointer[userid] == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t stickerStruct
-		err := decoder.Decode(&t)
+		upload, err := decodePayload(w, r, &t, "Sticker")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
 			return
 		}
 
@@ -1027,7 +1054,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		if t.Sticker == "" {
+		if t.Sticker == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sticker in Payload"))
 			return
 		}
@@ -1048,21 +1075,26 @@ func (s *server) SendSticker() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Sticker[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Sticker)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("data should start with \"data:mime/type;base64,\""))
+		media, err := getMedia(r, upload, t.Sticker)
+		if err != nil {
+			s.respondMediaError(w, r, err, err)
+			return
+		}
+		if !strings.HasPrefix(media.Mimetype, "image/") {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported sticker type %s", media.Mimetype))
+			return
+		}
+
+		sticker, err := makeSticker(media.Data, stickerMeta{PackName: t.PackName, PackAuthor: t.PackAuthor, Emojis: t.Emojis})
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		filedata = sticker.Data
+		uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
 			return
 		}
 
@@ -1070,28 +1102,29 @@ func (s *server) SendSticker() http.HandlerFunc {
 			Url:           proto.String(uploaded.URL),
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      proto.String("image/webp"),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
+			Width:         proto.Uint32(stickerSize),
+			Height:        proto.Uint32(stickerSize),
+			IsAnimated:    proto.Bool(sticker.Animated),
 			PngThumbnail:  t.PngThumbnail,
 		}}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, "")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1110,6 +1143,8 @@ func (s *server) SendVideo() http.HandlerFunc {
 		Caption       string
 		Id            string
 		JpegThumbnail []byte
+		Seconds       uint32
+		ViewOnce      bool
 		ContextInfo   waProto.ContextInfo
 	}
 
@@ -1118,18 +1153,16 @@ func (s *server) SendVideo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientPointer[userid] == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
 		var t imageStruct
-		err := decoder.Decode(&t)
+		upload, err := decodePayload(w, r, &t, "Video")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
 			return
 		}
 
@@ -1138,7 +1171,7 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		if t.Video == "" {
+		if t.Video == "" && upload == nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Video in Payload"))
 			return
 		}
@@ -1159,21 +1192,20 @@ func (s *server) SendVideo() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Video[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Video)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("data should start with \"data:mime/type;base64,\""))
+		media, err := getMedia(r, upload, t.Video)
+		if err != nil {
+			s.respondMediaError(w, r, err, err)
+			return
+		}
+		if !strings.HasPrefix(media.Mimetype, "video/") {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported video type %s", media.Mimetype))
+			return
+		}
+
+		filedata = media.Data
+		uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to upload file %s", err))
 			return
 		}
 
@@ -1182,28 +1214,47 @@ func (s *server) SendVideo() http.HandlerFunc {
 			Url:           proto.String(uploaded.URL),
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      proto.String(media.Mimetype),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JpegThumbnail: t.JpegThumbnail,
 		}}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		if meta, ok := getVideoMeta(filedata); ok {
+			msg.VideoMessage.Seconds = proto.Uint32(meta.Seconds)
+			if meta.Width > 0 {
+				msg.VideoMessage.Width = proto.Uint32(meta.Width)
+				msg.VideoMessage.Height = proto.Uint32(meta.Height)
+			}
+		}
+		if t.Seconds > 0 {
+			msg.VideoMessage.Seconds = proto.Uint32(t.Seconds)
+		}
+		if len(t.JpegThumbnail) > 0 {
+			// Accept any image format and size, and send a proper small JPEG
+			if meta, err := getImageMeta(t.JpegThumbnail); err != nil {
+				log.Warn().Err(err).Str("id", msgid).Msg("Could not decode video thumbnail")
+			} else {
+				msg.VideoMessage.JpegThumbnail = meta.Thumbnail
 			}
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Caption)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setContextInfo(msg, contextInfo)
+		if t.ViewOnce {
+			msg = wrapViewOnce(msg)
+		}
+
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1221,6 +1272,7 @@ func (s *server) SendContact() http.HandlerFunc {
 		Id          string
 		Name        string
 		Vcard       string
+		Contacts    []contactCard
 		ContextInfo waProto.ContextInfo
 	}
 
@@ -1235,7 +1287,6 @@ func (s *server) SendContact() http.HandlerFunc {
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t contactStruct
@@ -1248,15 +1299,30 @@ func (s *server) SendContact() http.HandlerFunc {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Name in Payload"))
+		if t.Vcard == "" && len(t.Contacts) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Vcard or Contacts in Payload"))
 			return
 		}
-		if t.Vcard == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Vcard in Payload"))
+		if t.Vcard != "" && t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Name in Payload"))
 			return
 		}
 
+		var contacts []*waProto.ContactMessage
+		if t.Vcard != "" {
+			contacts = append(contacts, &waProto.ContactMessage{DisplayName: proto.String(t.Name), Vcard: proto.String(t.Vcard)})
+		}
+		for i := range t.Contacts {
+			if err := t.Contacts[i].validate(); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			contacts = append(contacts, &waProto.ContactMessage{
+				DisplayName: proto.String(t.Contacts[i].Name),
+				Vcard:       proto.String(t.Contacts[i].vcard()),
+			})
+		}
+
 		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
 		if err != nil {
 			log.Error().Msg(fmt.Sprintf("%s", err))
@@ -1270,26 +1336,27 @@ func (s *server) SendContact() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
-			DisplayName: &t.Name,
-			Vcard:       &t.Vcard,
-		}}
+		// Only a single contact uses Name for itself, for several it names
+		// the whole array
+		displayName := ""
+		if t.Vcard == "" {
+			displayName = t.Name
+		}
+		msg := buildContactsMessage(contacts, displayName)
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, "")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1303,11 +1370,9 @@ func (s *server) SendContact() http.HandlerFunc {
 func (s *server) SendLocation() http.HandlerFunc {
 
 	type locationStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Latitude    float64
-		Longitude   float64
+		Phone string
+		Id    string
+		locationFields
 		ContextInfo waProto.ContextInfo
 	}
 
@@ -1322,7 +1387,6 @@ func (s *server) SendLocation() http.HandlerFunc {
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t locationStruct
@@ -1335,12 +1399,8 @@ func (s *server) SendLocation() http.HandlerFunc {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
-		if t.Latitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Latitude in Payload"))
-			return
-		}
-		if t.Longitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Longitude in Payload"))
+		if err := t.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
@@ -1357,27 +1417,21 @@ func (s *server) SendLocation() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
-			DegreesLatitude:  &t.Latitude,
-			DegreesLongitude: &t.Longitude,
-			Name:             &t.Name,
-		}}
+		msg := t.message()
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, "")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1387,19 +1441,16 @@ func (s *server) SendLocation() http.HandlerFunc {
 	}
 }
 
-// Sends Buttons (not implemented, does not work)
-
-func (s *server) SendButtons() http.HandlerFunc {
+// Sends a poll
+func (s *server) SendPoll() http.HandlerFunc {
 
-	type buttonStruct struct {
-		ButtonId   string
-		ButtonText string
-	}
-	type textStruct struct {
-		Phone   string
-		Title   string
-		Buttons []buttonStruct
-		Id      string
+	type pollStruct struct {
+		Phone           string
+		Id              string
+		Question        string
+		Options         []string
+		SelectableCount int
+		ContextInfo     waProto.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1413,38 +1464,43 @@ func (s *server) SendButtons() http.HandlerFunc {
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t pollStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
 			return
 		}
-
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
-
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+		if t.Question == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Question in Payload"))
 			return
 		}
-
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
+		if len(t.Options) < 2 || len(t.Options) > maxPollOptions {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("polls must have between 2 and %d Options", maxPollOptions))
 			return
 		}
-		if len(t.Buttons) > 3 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+		seen := make(map[string]bool)
+		for _, option := range t.Options {
+			if option == "" || seen[option] {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("poll Options must be unique and not empty"))
+				return
+			}
+			seen[option] = true
+		}
+		if t.SelectableCount < 0 || t.SelectableCount > len(t.Options) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("SelectableCount must be between 0 and the number of Options"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
@@ -1454,34 +1510,21 @@ func (s *server) SendButtons() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var buttons []*waProto.ButtonsMessage_Button
-
-		for _, item := range t.Buttons {
-			buttons = append(buttons, &waProto.ButtonsMessage_Button{
-				ButtonId:       proto.String(item.ButtonId),
-				ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
-				Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
-				NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
-			})
-		}
+		msg := clientPointer[userid].BuildPollCreation(t.Question, t.Options, t.SelectableCount)
 
-		msg2 := &waProto.ButtonsMessage{
-			ContentText: proto.String(t.Title),
-			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
-			Buttons:     buttons,
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Question)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
-			Message: &waProto.Message{
-				ButtonsMessage: msg2,
-			},
-		}}, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1491,18 +1534,130 @@ func (s *server) SendButtons() http.HandlerFunc {
 	}
 }
 
-// SendList
-// https://github.com/tulir/whatsmeow/issues/305
-func (s *server) SendList() http.HandlerFunc {
+// Sends Buttons (not implemented, does not work)
 
-	type rowsStruct struct {
-		RowId       string
-		Title       string
-		Description string
-	}
+func (s *server) SendButtons() http.HandlerFunc {
 
-	type sectionsStruct struct {
-		Title string
+	type buttonStruct struct {
+		ButtonId   string
+		ButtonText string
+	}
+	type textStruct struct {
+		Phone       string
+		Title       string
+		FooterText  string
+		Buttons     []buttonStruct
+		Id          string
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		msgid := ""
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+			return
+		}
+
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
+			return
+		}
+		if len(t.Buttons) > 3 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = clientPointer[userid].GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var buttons []*waProto.ButtonsMessage_Button
+
+		for _, item := range t.Buttons {
+			buttons = append(buttons, &waProto.ButtonsMessage_Button{
+				ButtonId:       proto.String(item.ButtonId),
+				ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
+				Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+				NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
+			})
+		}
+
+		msg2 := &waProto.ButtonsMessage{
+			ContentText: proto.String(t.Title),
+			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+			Buttons:     buttons,
+		}
+		if t.FooterText != "" {
+			msg2.FooterText = proto.String(t.FooterText)
+		}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Title)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		msg := &waProto.Message{ButtonsMessage: msg2}
+		setContextInfo(msg, contextInfo)
+
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+			Message: msg,
+		}}, msgid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			return
+		}
+		response := outcome.response(msgid)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// SendList
+// https://github.com/tulir/whatsmeow/issues/305
+func (s *server) SendList() http.HandlerFunc {
+
+	type rowsStruct struct {
+		RowId       string
+		Title       string
+		Description string
+	}
+
+	type sectionsStruct struct {
+		Title string
 		Rows  []rowsStruct
 	}
 
@@ -1514,6 +1669,7 @@ func (s *server) SendList() http.HandlerFunc {
 		FooterText  string
 		Sections    []sectionsStruct
 		Id          string
+		ContextInfo waProto.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1527,12 +1683,11 @@ func (s *server) SendList() http.HandlerFunc {
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t listStruct
 		err := decoder.Decode(&t)
-		marshal, _ := json.Marshal(t)
+		marshal, _ := json.Marshal(&t)
 		fmt.Println(string(marshal))
 		if err != nil {
 			fmt.Println(err)
@@ -1608,19 +1763,23 @@ func (s *server) SendList() http.HandlerFunc {
 			Sections:    sections,
 			FooterText:  proto.String(t.FooterText),
 		}
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Title+"\n"+t.Description)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		msg := &waProto.Message{ListMessage: msg1}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, &waProto.Message{
 			ViewOnceMessage: &waProto.FutureProofMessage{
-				Message: &waProto.Message{
-					ListMessage: msg1,
-				},
-			}}, whatsmeow.SendRequestExtra{ID: msgid})
+				Message: msg,
+			}}, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1634,10 +1793,15 @@ func (s *server) SendList() http.HandlerFunc {
 func (s *server) SendMessage() http.HandlerFunc {
 
 	type textStruct struct {
-		Phone       string
-		Body        string
-		Id          string
-		ContextInfo waProto.ContextInfo
+		Phone         string
+		Body          string
+		Id            string
+		LinkPreview   bool
+		MatchedText   string
+		Title         string
+		Description   string
+		JpegThumbnail []byte
+		ContextInfo   waProto.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1651,7 +1815,6 @@ func (s *server) SendMessage() http.HandlerFunc {
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t textStruct
@@ -1692,21 +1855,51 @@ func (s *server) SendMessage() http.HandlerFunc {
 			},
 		}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		// Preview fields given by the caller take precedence over the ones
+		// fetched from the page. A failed fetch sends the text without preview.
+		matched := t.MatchedText
+		if matched == "" {
+			matched = findURL(t.Body)
+		}
+		preview := &linkPreview{Title: t.Title, Description: t.Description, Thumbnail: t.JpegThumbnail}
+		if t.LinkPreview && matched != "" && (preview.Title == "" || preview.Description == "" || preview.Thumbnail == nil) {
+			fetched, err := fetchLinkPreview(r.Context(), matched)
+			if err != nil {
+				log.Warn().Err(err).Str("url", matched).Msg("Failed to fetch link preview")
+			} else {
+				if preview.Title == "" {
+					preview.Title = fetched.Title
+				}
+				if preview.Description == "" {
+					preview.Description = fetched.Description
+				}
+				if preview.Thumbnail == nil {
+					preview.Thumbnail = fetched.Thumbnail
+				}
 			}
 		}
+		if matched != "" && preview.Title != "" {
+			msg.ExtendedTextMessage.MatchedText = proto.String(matched)
+			msg.ExtendedTextMessage.CanonicalUrl = proto.String(matched)
+			msg.ExtendedTextMessage.Title = proto.String(preview.Title)
+			msg.ExtendedTextMessage.Description = proto.String(preview.Description)
+			msg.ExtendedTextMessage.JpegThumbnail = preview.Thumbnail
+			msg.ExtendedTextMessage.PreviewType = waProto.ExtendedTextMessage_NONE.Enum()
+		}
+
+		contextInfo, err := s.buildContextInfo(userid, recipient, &t.ContextInfo, t.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setContextInfo(msg, contextInfo)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		outcome, err := s.sendOrQueue(r.Context(), userid, recipient, msg, msgid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := outcome.response(msgid)
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1716,24 +1909,26 @@ func (s *server) SendMessage() http.HandlerFunc {
 	}
 }
 
-/*
-// Sends a Template message
+// Sends a stored template with the given variables filled in, through the
+// send endpoint for its kind of message
 func (s *server) SendTemplate() http.HandlerFunc {
 
-	type buttonStruct struct {
-		DisplayText string
-		Id          string
-		Url         string
-		PhoneNumber string
-		Type        string
+	type templateStruct struct {
+		Phone     string
+		Name      string
+		Version   int
+		Variables map[string]string
+		Id        string
 	}
 
-	type templateStruct struct {
-		Phone   string
-		Content string
-		Footer  string
-		Id      string
-		Buttons []buttonStruct
+	senders := map[string]http.HandlerFunc{
+		"text":     s.SendMessage(),
+		"image":    s.SendImage(),
+		"video":    s.SendVideo(),
+		"audio":    s.SendAudio(),
+		"document": s.SendDocument(),
+		"buttons":  s.SendButtons(),
+		"list":     s.SendList(),
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1741,140 +1936,55 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-//var ts time.Time
-
 		decoder := json.NewDecoder(r.Body)
 		var t templateStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
 			return
 		}
 
 		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Content == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
 			return
 		}
 
-		if t.Footer == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Name in Payload"))
 			return
 		}
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+		mt, err := getTemplate(s.db, userid, t.Name, t.Version)
+		if errors.Is(err, errTemplateNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
 			return
-		}
-
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = clientPointer[userid].GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var buttons []*waProto.HydratedTemplateButton
-
-		id := 1
-		for _, item := range t.Buttons {
-			switch item.Type {
-			case "quickreply":
-				var idtext string
-				text := item.DisplayText
-				if item.Id == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = item.Id
-				}
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(idtext),
-						},
-					},
-				})
-			case "url":
-				text := item.DisplayText
-				url := item.Url
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
-						UrlButton: &waProto.HydratedURLButton{
-							DisplayText: &text,
-							Url:         &url,
-						},
-					},
-				})
-			case "call":
-				text := item.DisplayText
-				phonenumber := item.PhoneNumber
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
-						CallButton: &waProto.HydratedCallButton{
-							DisplayText: &text,
-							PhoneNumber: &phonenumber,
-						},
-					},
-				})
-			default:
-				text := item.DisplayText
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(string(id)),
-						},
-					},
-				})
-			}
-			id++
-		}
-
-		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
-			HydratedTemplate: &waProto.HydratedFourRowTemplate{
-				HydratedContentText: proto.String(t.Content),
-				HydratedFooterText:  proto.String(t.Footer),
-				HydratedButtons:     buttons,
-				TemplateId:          proto.String("1"),
-			},
-		},
-		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(),recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		kind, payload, err := mt.render(t.Variables)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("could not render template: %v", err))
 			return
 		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		payload["Phone"] = t.Phone
+		payload["Id"] = t.Id
+		body, err := json.Marshal(payload)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			return
 		}
-		return
+
+		log.Info().Str("template", mt.Name).Int("version", mt.Version).Str("kind", kind).Msg("Sending template")
+		send := r.Clone(r.Context())
+		send.Body = io.NopCloser(bytes.NewReader(body))
+		send.ContentLength = int64(len(body))
+		send.Header.Set("Content-Type", "application/json")
+		senders[kind](w, send)
 	}
 }
-*/
+
 // checks if users/phones are on Whatsapp
 func (s *server) CheckUser() http.HandlerFunc {
 
@@ -2093,19 +2203,1705 @@ func (s *server) GetContacts() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		// result := map[types.JID]types.ContactInfo{}
+		result, err := clientPointer[userid].Store.Contacts.GetAllContacts()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets Chat Presence (typing/paused/recording audio)
+func (s *server) ChatPresence() http.HandlerFunc {
+
+	type chatPresenceStruct struct {
+		Phone string
+		State string
+		Media types.ChatPresenceMedia
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t chatPresenceStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if len(t.State) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing State in Payload"))
+			return
+		}
+
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		err = clientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failure sending chat presence to Whatsapp servers"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Chat presence set successfully"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// DownloadMedia is a generic function to handle downloading of various media types
+func (s *server) DownloadMedia(mediaType string) http.HandlerFunc {
+	type downloadMediaStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		// Check/create user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		if err := os.MkdirAll(userDirectory, 0751); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not create user directory (%s)", userDirectory))
+			return
+		}
+
+		var t downloadMediaStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		var downloadable whatsmeow.DownloadableMessage
+		var mimetype string
+
+		switch mediaType {
+		case "Image":
+			msg := &waProto.ImageMessage{
+				Url:           proto.String(t.Url),
+				DirectPath:    proto.String(t.DirectPath),
+				MediaKey:      t.MediaKey,
+				Mimetype:      proto.String(t.Mimetype),
+				FileEncSha256: t.FileEncSHA256,
+				FileSha256:    t.FileSHA256,
+				FileLength:    &t.FileLength,
+			}
+			downloadable = msg
+			mimetype = msg.GetMimetype()
+		case "Document":
+			msg := &waProto.DocumentMessage{
+				Url:           proto.String(t.Url),
+				DirectPath:    proto.String(t.DirectPath),
+				MediaKey:      t.MediaKey,
+				Mimetype:      proto.String(t.Mimetype),
+				FileEncSha256: t.FileEncSHA256,
+				FileSha256:    t.FileSHA256,
+				FileLength:    &t.FileLength,
+			}
+			downloadable = msg
+			mimetype = msg.GetMimetype()
+		case "Video":
+			msg := &waProto.VideoMessage{
+				Url:           proto.String(t.Url),
+				DirectPath:    proto.String(t.DirectPath),
+				MediaKey:      t.MediaKey,
+				Mimetype:      proto.String(t.Mimetype),
+				FileEncSha256: t.FileEncSHA256,
+				FileSha256:    t.FileSHA256,
+				FileLength:    &t.FileLength,
+			}
+			downloadable = msg
+			mimetype = msg.GetMimetype()
+		case "Audio":
+			msg := &waProto.AudioMessage{
+				Url:           proto.String(t.Url),
+				DirectPath:    proto.String(t.DirectPath),
+				MediaKey:      t.MediaKey,
+				Mimetype:      proto.String(t.Mimetype),
+				FileEncSha256: t.FileEncSHA256,
+				FileSha256:    t.FileSHA256,
+				FileLength:    &t.FileLength,
+			}
+			downloadable = msg
+			mimetype = msg.GetMimetype()
+		default:
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("invalid media type: %s", mediaType))
+			return
+		}
+
+		client := clientPointer[userid]
+		if wantsRawMedia(r) {
+			err := s.respondRawDownload(w, r, mimetype, strings.ToLower(mediaType), func(file *os.File) error {
+				return downloadToFile(client, downloadable, file)
+			})
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msgf("Failed to download %s", mediaType)
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to download %s %v", mediaType, err))
+			}
+			return
+		}
+
+		data, err := client.Download(downloadable)
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msgf("Failed to download %s", mediaType)
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to download %s %v", mediaType, err))
+			return
+		}
+
+		s.respondDownload(w, r, data, mimetype)
+	}
+}
+
+// Downloads media from a message in the local message index
+func (s *server) DownloadMessage() http.HandlerFunc {
+
+	type downloadMessageStruct struct {
+		Id   string
+		Chat string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadMessageStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		}
+
+		chat := ""
+		if t.Chat != "" {
+			jid, ok := parseJID(t.Chat)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Chat"))
+				return
+			}
+			chat = jid.String()
+		}
+
+		indexed, err := getIndexedMessage(s.db, userid, chat, t.Id)
+		if errors.Is(err, errMessageNotIndexed) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		mediaType, downloadable := getDownloadable(indexed.Message)
+		if downloadable == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("message has no media"))
+			return
+		}
+
+		mimetype := ""
+		if m, ok := downloadable.(interface{ GetMimetype() string }); ok {
+			mimetype = m.GetMimetype()
+		}
+
+		client := clientPointer[userid]
+		if wantsRawMedia(r) {
+			err := s.respondRawDownload(w, r, mimetype, indexed.ID, func(file *os.File) error {
+				return fetchIndexedMedia(client, s.db, userid, indexed, func(msg whatsmeow.DownloadableMessage) error {
+					return downloadToFile(client, msg, file)
+				})
+			})
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Str("id", t.Id).Msgf("Failed to download %s", mediaType)
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to download %s %v", mediaType, err))
+			}
+			return
+		}
+
+		data, err := downloadIndexedMedia(client, s.db, userid, indexed)
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Str("id", t.Id).Msgf("Failed to download %s", mediaType)
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to download %s %v", mediaType, err))
+			return
+		}
+
+		s.respondDownload(w, r, data, mimetype)
+	}
+}
+
+// Use the generic DownloadMedia function for each media type
+func (s *server) DownloadImage() http.HandlerFunc {
+	return s.DownloadMedia("Image")
+}
+
+func (s *server) DownloadDocument() http.HandlerFunc {
+	return s.DownloadMedia("Document")
+}
+
+func (s *server) DownloadVideo() http.HandlerFunc {
+	return s.DownloadMedia("Video")
+}
+
+func (s *server) DownloadAudio() http.HandlerFunc {
+	return s.DownloadMedia("Audio")
+}
+
+// React
+func (s *server) React() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone string
+		Body  string
+		Id    string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Body in Payload"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Group JID"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		} else {
+			msgid = t.Id
+		}
+
+		fromMe := false
+		if strings.HasPrefix(msgid, "me:") {
+			fromMe = true
+			msgid = msgid[len("me:"):]
+		}
+		reaction := t.Body
+		if reaction == "remove" {
+			reaction = ""
+		}
+
+		msg := &waProto.Message{
+			ReactionMessage: &waProto.ReactionMessage{
+				Key: &waProto.MessageKey{
+					RemoteJid: proto.String(recipient.String()),
+					FromMe:    proto.Bool(fromMe),
+					Id:        proto.String(msgid),
+				},
+				Text:              proto.String(reaction),
+				GroupingKey:       proto.String(reaction),
+				SenderTimestampMs: proto.Int64(time.Now().UnixMilli()),
+			},
+		}
+
+		resp, err = s.sendMessage(context.Background(), userid, recipient, msg, msgid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			return
+		}
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Edits the text or caption of a sent message
+func (s *server) EditMessage() http.HandlerFunc {
+
+	type editStruct struct {
+		Phone string
+		Id    string
+		Body  string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t editStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		}
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Body in Payload"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		// Captions can only be edited when the original message is known,
+		// anything else is edited as text
+		content := &waProto.Message{Conversation: proto.String(t.Body)}
+		original, err := getIndexedMessage(s.db, userid, recipient.String(), t.Id)
+		if err == nil {
+			if !original.FromMe {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("only messages sent by this account can be edited"))
+				return
+			}
+			if time.Since(original.Timestamp) > whatsmeow.EditWindow {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("message can no longer be edited"))
+				return
+			}
+			content = proto.Clone(original.Message).(*waProto.Message)
+			if !setMessageText(content, t.Body) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("message has no text or caption to edit"))
+				return
+			}
+		} else if !errors.Is(err, errMessageNotIndexed) {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		msgid := clientPointer[userid].GenerateMessageID()
+		msg := clientPointer[userid].BuildEdit(recipient, t.Id, content)
+
+		resp, err := s.sendMessage(context.Background(), userid, recipient, msg, msgid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			return
+		}
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message edited")
+		response := map[string]interface{}{"Details": "Edited", "Timestamp": resp.Timestamp, "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Deletes a message for everyone. Group admins can delete messages of other participants.
+func (s *server) RevokeMessage() http.HandlerFunc {
+
+	type revokeStruct struct {
+		Phone       string
+		Id          string
+		Participant string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t revokeStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		// The sender is needed to revoke someone else's message as admin. It
+		// is taken from the payload or, failing that, from the message index.
+		sender := types.EmptyJID
+		if t.Participant != "" {
+			sender, ok = parseJID(t.Participant)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Participant"))
+				return
+			}
+		} else if original, err := getIndexedMessage(s.db, userid, recipient.String(), t.Id); err == nil && !original.FromMe {
+			sender = original.Sender
+		}
+		if !sender.IsEmpty() && recipient.Server != types.GroupServer {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("messages from other users can only be revoked in groups"))
+			return
+		}
+
+		msgid := clientPointer[userid].GenerateMessageID()
+		msg := clientPointer[userid].BuildRevoke(recipient, sender, t.Id)
+
+		resp, err := s.sendMessage(context.Background(), userid, recipient, msg, msgid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			return
+		}
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message revoked")
+		response := map[string]interface{}{"Details": "Revoked", "Timestamp": resp.Timestamp, "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Forwards an indexed message to one or more chats
+func (s *server) ForwardMessage() http.HandlerFunc {
+
+	type forwardStruct struct {
+		Id     string
+		Chat   string
+		Phones []string
+	}
+
+	type forwardResult struct {
+		Phone     string
+		Id        string     `json:",omitempty"`
+		Timestamp *time.Time `json:",omitempty"`
+		Error     string     `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t forwardStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+			return
+		}
+		if len(t.Phones) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phones in Payload"))
+			return
+		}
+
+		recipients := make([]types.JID, len(t.Phones))
+		for i, phone := range t.Phones {
+			jid, ok := parseJID(phone)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("could not parse Phone %s", phone))
+				return
+			}
+			recipients[i] = jid
+		}
+
+		chat := ""
+		if t.Chat != "" {
+			jid, ok := parseJID(t.Chat)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Chat"))
+				return
+			}
+			chat = jid.String()
+		}
+
+		indexed, err := getIndexedMessage(s.db, userid, chat, t.Id)
+		if errors.Is(err, errMessageNotIndexed) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		msg, err := buildForward(indexed)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		err = refreshForwardMedia(r.Context(), clientPointer[userid], s.db, userid, indexed, msg)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("media of the message is no longer available: %v", err))
+			return
+		}
+
+		// Every destination gets its own copy, as sending adds the
+		// disappearing timer of the chat to the message
+		results := make([]forwardResult, len(recipients))
+		for i, recipient := range recipients {
+			results[i].Phone = t.Phones[i]
+			msgid := clientPointer[userid].GenerateMessageID()
+			resp, err := s.sendMessage(context.Background(), userid, recipient, proto.Clone(msg).(*waProto.Message), msgid)
+			if err != nil {
+				log.Error().Err(err).Str("to", recipient.String()).Str("id", t.Id).Msg("Failed to forward message")
+				results[i].Error = fmt.Sprintf("error sending message: %v", err)
+				continue
+			}
+			log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Str("original", t.Id).Msg("Message forwarded")
+			results[i].Id = msgid
+			results[i].Timestamp = &resp.Timestamp
+		}
+
+		response := map[string]interface{}{"Details": "Forwarded", "Id": t.Id, "Results": results}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the results of a poll
+func (s *server) GetPoll() http.HandlerFunc {
+
+	type optionResult struct {
+		Name   string
+		Votes  int
+		Voters []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		pollID := mux.Vars(r)["id"]
+
+		chat := ""
+		if c := r.URL.Query().Get("chat"); c != "" {
+			jid, ok := parseJID(c)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
+				return
+			}
+			chat = jid.String()
+		}
+
+		indexed, err := getIndexedMessage(s.db, userid, chat, pollID)
+		if errors.Is(err, errMessageNotIndexed) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("poll not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		poll := getPollCreation(indexed.Message)
+		if poll == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("message is not a poll"))
+			return
+		}
+
+		votes, err := getPollVotes(s.db, userid, indexed.Chat, pollID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		options := make([]*optionResult, len(poll.GetOptions()))
+		byName := make(map[string]*optionResult)
+		for i, option := range poll.GetOptions() {
+			options[i] = &optionResult{Name: option.GetOptionName(), Voters: []string{}}
+			byName[option.GetOptionName()] = options[i]
+		}
+		voters := 0
+		for _, vote := range votes {
+			if len(vote.Options) > 0 {
+				voters++
+			}
+			for _, name := range vote.Options {
+				if result, ok := byName[name]; ok {
+					result.Votes++
+					result.Voters = append(result.Voters, vote.Voter)
+				}
+			}
+		}
+
+		response := map[string]interface{}{
+			"Id":              pollID,
+			"Chat":            indexed.Chat.String(),
+			"Question":        poll.GetName(),
+			"SelectableCount": poll.GetSelectableOptionsCount(),
+			"Options":         options,
+			"TotalVoters":     voters,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets whether messages are kept in the message store
+func (s *server) GetMessageStore() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		response := map[string]interface{}{"Enabled": messageStoreEnabled(s.db, userid)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Turns the message store on or off
+func (s *server) SetMessageStore() http.HandlerFunc {
+
+	type messageStoreStruct struct {
+		Enabled *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t messageStoreStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if t.Enabled == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Enabled in Payload"))
+			return
+		}
+
+		if err := setMessageStoreEnabled(s.db, userid, *t.Enabled); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not set message store: %v", err))
+			return
+		}
+
+		response := map[string]interface{}{"Enabled": *t.Enabled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists chats with their unread count and last message
+func (s *server) ListChats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		filter := chatFilter{Groups: true, Direct: true, Limit: defaultChatsLimit}
+		switch r.URL.Query().Get("type") {
+		case "":
+		case "group":
+			filter.Direct = false
+		case "direct":
+			filter.Groups = false
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("type must be group or direct"))
+			return
+		}
+		if unread := r.URL.Query().Get("unread"); unread != "" {
+			b, err := strconv.ParseBool(unread)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("unread must be true or false"))
+				return
+			}
+			filter.UnreadOnly = b
+		}
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxChatsLimit {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxChatsLimit))
+				return
+			}
+			filter.Limit = n
+		}
+		if o := r.URL.Query().Get("offset"); o != "" {
+			n, err := strconv.Atoi(o)
+			if err != nil || n < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("offset can not be negative"))
+				return
+			}
+			filter.Offset = n
+		}
+
+		chats, err := listChats(s.db, userid, filter)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if client := clientPointer[userid]; client != nil {
+			resolveChatNames(client, s.db, userid, chats)
+		}
+
+		response := map[string]interface{}{"Chats": chats}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the stored messages of a chat, newest first
+func (s *server) GetChatMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		chat, ok := parseJID(mux.Vars(r)["jid"])
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
+			return
+		}
+
+		limit := defaultHistoryLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxHistoryLimit {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit))
+				return
+			}
+			limit = n
+		}
+
+		messages, next, err := getStoredMessages(s.db, userid, chat.String(), r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			if errors.Is(err, errInvalidCursor) {
+				s.Respond(w, r, http.StatusBadRequest, err)
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response := map[string]interface{}{"Chat": chat.String(), "Messages": messages, "NextCursor": next}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a stored message
+func (s *server) GetMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		chat := ""
+		if c := r.URL.Query().Get("chat"); c != "" {
+			jid, ok := parseJID(c)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
+				return
+			}
+			chat = jid.String()
+		}
+
+		message, err := getStoredMessage(s.db, userid, chat, mux.Vars(r)["id"])
+		if errors.Is(err, errMessageNotStored) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the delivery status of a message sent through the API
+func (s *server) GetMessageStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		chat := ""
+		if c := r.URL.Query().Get("chat"); c != "" {
+			jid, ok := parseJID(c)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
+				return
+			}
+			chat = jid.String()
+		}
+
+		status, err := getMessageStatus(s.db, userid, chat, mux.Vars(r)["id"])
+		if errors.Is(err, errMessageStatusNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(status)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the send queue settings
+func (s *server) GetQueueSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		settings, err := getQueueSettings(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(settings)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Turns queued sends on or off and sets their pacing
+func (s *server) SetQueueSettings() http.HandlerFunc {
+
+	type queueSettingsStruct struct {
+		Enabled       *bool
+		PerMinute     *int
+		JitterSeconds *int
+		Typing        *bool
+		DailyCap      *int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t queueSettingsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		// Fields left out keep their current value
+		settings, err := getQueueSettings(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if t.Enabled != nil {
+			settings.Enabled = *t.Enabled
+		}
+		if t.PerMinute != nil {
+			settings.PerMinute = *t.PerMinute
+		}
+		if t.JitterSeconds != nil {
+			settings.JitterSeconds = *t.JitterSeconds
+		}
+		if t.Typing != nil {
+			settings.Typing = *t.Typing
+		}
+		if t.DailyCap != nil {
+			settings.DailyCap = *t.DailyCap
+		}
+		if err := settings.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := saveQueueSettings(s.db, userid, settings); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not set queue settings: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(settings)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the messages waiting in the send queue
+func (s *server) GetQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		messages, err := listQueuedMessages(s.db, userid, defaultQueueListLimit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		pending, sentToday, err := countQueuedMessages(s.db, userid, startOfDay(time.Now()))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := map[string]interface{}{"Pending": pending, "SentToday": sentToday, "Messages": messages}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a message of the send queue
+func (s *server) GetQueuedMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		message, err := getQueuedMessage(s.db, userid, mux.Vars(r)["id"])
+		if errors.Is(err, errQueuedMessageNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancels a message waiting in the send queue
+func (s *server) CancelQueuedMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		id := mux.Vars(r)["id"]
+		err := cancelQueuedMessage(s.db, userid, id)
+		if errors.Is(err, errQueuedMessageNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errQueuedMessageNotDue) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Cancelled", "Id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the scheduled messages, by when they are sent next
+func (s *server) ListScheduledMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		all := false
+		if a := r.URL.Query().Get("all"); a != "" {
+			b, err := strconv.ParseBool(a)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("all must be true or false"))
+				return
+			}
+			all = b
+		}
+
+		messages, err := listScheduledMessages(s.db, userid, all)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(messages)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a scheduled message
+func (s *server) GetScheduledMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		message, err := getScheduledMessage(s.db, userid, mux.Vars(r)["id"])
+		if errors.Is(err, errScheduleNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Changes when a scheduled message is sent
+func (s *server) UpdateScheduledMessage() http.HandlerFunc {
+
+	type scheduleStruct struct {
+		SendAt   string
+		Cron     string
+		Timezone string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var t scheduleStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		schedule, err := parseSendSchedule(t.SendAt, t.Cron, t.Timezone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if schedule == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing SendAt or Cron in Payload"))
+			return
+		}
+
+		message, err := rescheduleMessage(s.db, userid, mux.Vars(r)["id"], schedule)
+		if errors.Is(err, errScheduleNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errScheduleNotActive) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancels a scheduled message, including all future runs of a recurring one
+func (s *server) CancelScheduledMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		id := mux.Vars(r)["id"]
+		err := cancelScheduledMessage(s.db, userid, id)
+		if errors.Is(err, errScheduleNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errScheduleNotActive) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Cancelled", "Id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Starts a broadcast of a text message to a list of recipients, given as
+// JSON or as a CSV file uploaded in the Recipients field of a form
+func (s *server) CreateBroadcast() http.HandlerFunc {
+
+	type broadcastStruct struct {
+		Name          string
+		Body          string
+		Recipients    []broadcastRecipient
+		PerMinute     *int
+		JitterSeconds *int
+		Typing        *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var t broadcastStruct
+		upload, err := decodePayload(w, r, &t, "Recipients")
+		if err != nil {
+			s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
+			return
+		}
+		if upload != nil {
+			recipients, err := parseRecipientsCSV(bytes.NewReader(upload.Data))
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			t.Recipients = append(t.Recipients, recipients...)
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Body in Payload"))
+			return
+		}
+		recipients, err := prepareBroadcastRecipients(t.Body, t.Recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Pacing defaults to the one of the send queue
+		pacing, err := getQueueSettings(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not get queue settings: %v", err))
+			return
+		}
+		if t.PerMinute != nil {
+			pacing.PerMinute = *t.PerMinute
+		}
+		if t.JitterSeconds != nil {
+			pacing.JitterSeconds = *t.JitterSeconds
+		}
+		if t.Typing != nil {
+			pacing.Typing = *t.Typing
+		}
+		if err := pacing.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		job := &broadcastJob{
+			Id:            newBroadcastID(),
+			Name:          t.Name,
+			Body:          t.Body,
+			PerMinute:     pacing.PerMinute,
+			JitterSeconds: pacing.JitterSeconds,
+			Typing:        pacing.Typing,
+		}
+		if err := createBroadcast(s.db, userid, job, recipients); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not create broadcast: %v", err))
+			return
+		}
+		log.Info().Str("id", job.Id).Int("recipients", len(recipients)).Msg("Broadcast created")
+
+		job, err = getBroadcastWithStats(s.db, userid, job.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the latest broadcasts with their stats
+func (s *server) ListBroadcasts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		jobs, err := listBroadcasts(s.db, userid, defaultBroadcastsLimit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(jobs)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a broadcast with its stats
+func (s *server) GetBroadcast() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		job, err := getBroadcastWithStats(s.db, userid, mux.Vars(r)["id"])
+		if errors.Is(err, errBroadcastNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the results of a broadcast for each recipient
+func (s *server) GetBroadcastRecipients() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		id := mux.Vars(r)["id"]
+		if _, err := getBroadcast(s.db, userid, id); errors.Is(err, errBroadcastNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		limit := defaultRecipientsLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxRecipientsLimit {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxRecipientsLimit))
+				return
+			}
+			limit = n
+		}
+		offset := 0
+		if o := r.URL.Query().Get("offset"); o != "" {
+			n, err := strconv.Atoi(o)
+			if err != nil || n < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("offset must be a positive number"))
+				return
+			}
+			offset = n
+		}
+
+		results, err := listBroadcastRecipients(s.db, userid, id, status, limit, offset)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(results)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Pauses a running broadcast after the message being sent, if any
+func (s *server) PauseBroadcast() http.HandlerFunc {
+	return s.changeBroadcastStatus([]string{broadcastRunning}, broadcastPaused, "Paused")
+}
+
+// Resumes a paused broadcast with the recipients left
+func (s *server) ResumeBroadcast() http.HandlerFunc {
+	return s.changeBroadcastStatus([]string{broadcastPaused}, broadcastRunning, "Resumed")
+}
+
+// Cancels a broadcast, skipping the recipients left
+func (s *server) CancelBroadcast() http.HandlerFunc {
+	return s.changeBroadcastStatus([]string{broadcastRunning, broadcastPaused}, broadcastCancelled, "Cancelled")
+}
+
+func (s *server) changeBroadcastStatus(from []string, to string, details string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		id := mux.Vars(r)["id"]
+		err := setBroadcastStatus(s.db, userid, id, from, to)
+		if errors.Is(err, errBroadcastNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errBroadcastFinished) || errors.Is(err, errBroadcastNotRunning) || errors.Is(err, errBroadcastNotPaused) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		log.Info().Str("id", id).Str("status", to).Msg("Broadcast status changed")
+
+		response := map[string]interface{}{"Details": details, "Id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Stores a new template
+func (s *server) CreateTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var mt messageTemplate
+		if err := json.NewDecoder(r.Body).Decode(&mt); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if err := mt.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		err := saveTemplate(s.db, userid, &mt, false)
+		if errors.Is(err, errTemplateExists) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not save template: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(mt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the latest version of every template
+func (s *server) ListTemplates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		templates, err := listTemplates(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(templates)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the latest version of a template, or the one given in version
+func (s *server) GetTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("version must be a positive number"))
+				return
+			}
+			version = n
+		}
+
+		mt, err := getTemplate(s.db, userid, mux.Vars(r)["name"], version)
+		if errors.Is(err, errTemplateNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(mt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists all versions of a template, newest first
+func (s *server) GetTemplateVersions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		templates, err := listTemplateVersions(s.db, userid, mux.Vars(r)["name"])
+		if errors.Is(err, errTemplateNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(templates)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Stores a new version of a template
+func (s *server) UpdateTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var mt messageTemplate
+		if err := json.NewDecoder(r.Body).Decode(&mt); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		mt.Name = mux.Vars(r)["name"]
+		if err := mt.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		err := saveTemplate(s.db, userid, &mt, true)
+		if errors.Is(err, errTemplateNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, errTemplateChanged) {
+			s.Respond(w, r, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not save template: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(mt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Deletes a template with all its versions
+func (s *server) DeleteTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		name := mux.Vars(r)["name"]
+		err := deleteTemplate(s.db, userid, name)
+		if errors.Is(err, errTemplateNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
 			return
-		}
-
-		// result := map[types.JID]types.ContactInfo{}
-		result, err := clientPointer[userid].Store.Contacts.GetAllContacts()
-		if err != nil {
+		} else if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		responseJson, err := json.Marshal(result)
+		response := map[string]interface{}{"Details": "Deleted", "Name": name}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2114,13 +3910,12 @@ func (s *server) GetContacts() http.HandlerFunc {
 	}
 }
 
-// Sets Chat Presence (typing/paused/recording audio)
-func (s *server) ChatPresence() http.HandlerFunc {
+// Asks the phone for older messages of a chat
+func (s *server) BackfillHistory() http.HandlerFunc {
 
-	type chatPresenceStruct struct {
-		Phone string
-		State string
-		Media types.ChatPresenceMedia
+	type backfillStruct struct {
+		BeforeId string
+		Count    int
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2133,38 +3928,56 @@ func (s *server) ChatPresence() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t chatPresenceStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+		// An empty body asks for the default number of messages
+		var t backfillStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
+		}
+		if t.Count == 0 {
+			t.Count = defaultBackfillCount
+		}
+		if t.Count < 1 || t.Count > maxBackfillCount {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("count must be between 1 and %d", maxBackfillCount))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+		chat, ok := parseJID(mux.Vars(r)["jid"])
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse chat"))
 			return
 		}
 
-		if len(t.State) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing State in Payload"))
+		if !messageStoreEnabled(s.db, userid) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("message store is not enabled"))
 			return
 		}
 
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+		var before *indexedMessage
+		var err error
+		if t.BeforeId != "" {
+			before, err = getIndexedMessage(s.db, userid, chat.String(), t.BeforeId)
+		} else {
+			before, err = getOldestIndexedMessage(s.db, userid, chat)
+		}
+		if errors.Is(err, errMessageNotIndexed) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("no known message in chat to backfill from"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		err = clientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		job, err := requestBackfill(r.Context(), clientPointer[userid], s.db, userid, before, t.Count)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("failure sending chat presence to Whatsapp servers"))
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
+		log.Info().Str("job", job.Id).Str("chat", job.Chat).Str("before", job.BeforeId).Int("count", job.Count).Msg("History backfill requested")
 
-		response := map[string]interface{}{"Details": "Chat presence set successfully"}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(job)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2173,107 +3986,23 @@ func (s *server) ChatPresence() http.HandlerFunc {
 	}
 }
 
-// DownloadMedia is a generic function to handle downloading of various media types
-func (s *server) DownloadMedia(mediaType string) http.HandlerFunc {
-	type downloadMediaStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
-	}
-
+// Gets the progress of a history backfill request
+func (s *server) GetBackfillJob() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
-			return
-		}
-
-		// Check/create user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		if err := os.MkdirAll(userDirectory, 0751); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("could not create user directory (%s)", userDirectory))
-			return
-		}
-
-		var t downloadMediaStruct
-		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
-			return
-		}
-
-		var downloadable whatsmeow.DownloadableMessage
-		var mimetype string
-
-		switch mediaType {
-		case "Image":
-			msg := &waProto.ImageMessage{
-				Url:           proto.String(t.Url),
-				DirectPath:    proto.String(t.DirectPath),
-				MediaKey:      t.MediaKey,
-				Mimetype:      proto.String(t.Mimetype),
-				FileEncSha256: t.FileEncSHA256,
-				FileSha256:    t.FileSHA256,
-				FileLength:    &t.FileLength,
-			}
-			downloadable = msg
-			mimetype = msg.GetMimetype()
-		case "Document":
-			msg := &waProto.DocumentMessage{
-				Url:           proto.String(t.Url),
-				DirectPath:    proto.String(t.DirectPath),
-				MediaKey:      t.MediaKey,
-				Mimetype:      proto.String(t.Mimetype),
-				FileEncSha256: t.FileEncSHA256,
-				FileSha256:    t.FileSHA256,
-				FileLength:    &t.FileLength,
-			}
-			downloadable = msg
-			mimetype = msg.GetMimetype()
-		case "Video":
-			msg := &waProto.VideoMessage{
-				Url:           proto.String(t.Url),
-				DirectPath:    proto.String(t.DirectPath),
-				MediaKey:      t.MediaKey,
-				Mimetype:      proto.String(t.Mimetype),
-				FileEncSha256: t.FileEncSHA256,
-				FileSha256:    t.FileSHA256,
-				FileLength:    &t.FileLength,
-			}
-			downloadable = msg
-			mimetype = msg.GetMimetype()
-		case "Audio":
-			msg := &waProto.AudioMessage{
-				Url:           proto.String(t.Url),
-				DirectPath:    proto.String(t.DirectPath),
-				MediaKey:      t.MediaKey,
-				Mimetype:      proto.String(t.Mimetype),
-				FileEncSha256: t.FileEncSHA256,
-				FileSha256:    t.FileSHA256,
-				FileLength:    &t.FileLength,
-			}
-			downloadable = msg
-			mimetype = msg.GetMimetype()
-		default:
-			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("invalid media type: %s", mediaType))
+		job, err := getBackfillJob(s.db, userid, mux.Vars(r)["id"])
+		if errors.Is(err, errBackfillJobNotFound) {
+			s.Respond(w, r, http.StatusNotFound, err)
 			return
-		}
-
-		data, err := clientPointer[userid].Download(downloadable)
-		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msgf("Failed to download %s", mediaType)
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to download %s %v", mediaType, err))
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		dataURL := dataurl.New(data, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(job)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2282,30 +4011,12 @@ func (s *server) DownloadMedia(mediaType string) http.HandlerFunc {
 	}
 }
 
-// Use the generic DownloadMedia function for each media type
-func (s *server) DownloadImage() http.HandlerFunc {
-	return s.DownloadMedia("Image")
-}
-
-func (s *server) DownloadDocument() http.HandlerFunc {
-	return s.DownloadMedia("Document")
-}
-
-func (s *server) DownloadVideo() http.HandlerFunc {
-	return s.DownloadMedia("Video")
-}
-
-func (s *server) DownloadAudio() http.HandlerFunc {
-	return s.DownloadMedia("Audio")
-}
-
-// React
-func (s *server) React() http.HandlerFunc {
+// Sets the disappearing messages timer of a chat or group
+func (s *server) SetDisappearingTimer() http.HandlerFunc {
 
-	type textStruct struct {
+	type disappearingStruct struct {
 		Phone string
-		Body  string
-		Id    string
+		Timer string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2318,11 +4029,8 @@ func (s *server) React() http.HandlerFunc {
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t disappearingStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
@@ -2334,55 +4042,75 @@ func (s *server) React() http.HandlerFunc {
 			return
 		}
 
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Body in Payload"))
+		chat, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
+		timer, ok := whatsmeow.ParseDisappearingTimerString(t.Timer)
 		if !ok {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Group JID"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Timer, must be one of off, 24h, 7d or 90d"))
 			return
 		}
 
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Id in Payload"))
+		err = clientPointer[userid].SetDisappearingTimer(chat, timer)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to set disappearing timer: %v", err))
 			return
+		}
+		if err := saveDisappearingTimer(s.db, userid, chat, uint32(timer.Seconds())); err != nil {
+			log.Error().Err(err).Str("chat", chat.String()).Msg("Failed to save disappearing timer")
+		}
+
+		response := map[string]interface{}{"Details": "Disappearing timer set", "Chat": chat.String(), "Timer": uint32(timer.Seconds())}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		fromMe := false
-		if strings.HasPrefix(msgid, "me:") {
-			fromMe = true
-			msgid = msgid[len("me:"):]
+// Sets the default disappearing messages timer for new chats
+func (s *server) SetDefaultDisappearingTimer() http.HandlerFunc {
+
+	type disappearingStruct struct {
+		Timer string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientPointer[userid] == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
 		}
-		reaction := t.Body
-		if reaction == "remove" {
-			reaction = ""
+
+		decoder := json.NewDecoder(r.Body)
+		var t disappearingStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
 		}
 
-		msg := &waProto.Message{
-			ReactionMessage: &waProto.ReactionMessage{
-				Key: &waProto.MessageKey{
-					RemoteJid: proto.String(recipient.String()),
-					FromMe:    proto.Bool(fromMe),
-					Id:        proto.String(msgid),
-				},
-				Text:              proto.String(reaction),
-				GroupingKey:       proto.String(reaction),
-				SenderTimestampMs: proto.Int64(time.Now().UnixMilli()),
-			},
+		timer, ok := whatsmeow.ParseDisappearingTimerString(t.Timer)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Timer, must be one of off, 24h, 7d or 90d"))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		err = clientPointer[userid].SetDefaultDisappearingTimer(timer)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("error sending message: %v", err))
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("failed to set default disappearing timer: %v", err))
 			return
 		}
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+
+		response := map[string]interface{}{"Details": "Default disappearing timer set", "Timer": uint32(timer.Seconds())}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -2474,6 +4202,9 @@ func (s *server) ListGroups() http.HandlerFunc {
 		gc := new(GroupCollection)
 		for _, info := range resp {
 			gc.Groups = append(gc.Groups, *info)
+			if err := saveDisappearingTimer(s.db, userid, info.JID, groupDisappearingTimer(info.GroupEphemeral)); err != nil {
+				log.Error().Err(err).Str("group", info.JID.String()).Msg("Failed to save disappearing timer")
+			}
 		}
 
 		responseJson, err := json.Marshal(gc)
@@ -2525,6 +4256,10 @@ func (s *server) GetGroupInfo() http.HandlerFunc {
 			return
 		}
 
+		if err := saveDisappearingTimer(s.db, userid, resp.JID, groupDisappearingTimer(resp.GroupEphemeral)); err != nil {
+			log.Error().Err(err).Str("group", resp.JID.String()).Msg("Failed to save disappearing timer")
+		}
+
 		responseJson, err := json.Marshal(resp)
 
 		if err != nil {
@@ -2835,7 +4570,7 @@ func (s *server) AddUser() http.HandlerFunc {
 		}
 
 		// Validate the events input
-		validEvents := []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+		validEvents := []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "MessageEdit", "MessageRevoke", "PollVote", "LocationUpdate", "MessageStatus", "SendResult", "ScheduledSend", "All"}
 		eventList := strings.Split(user.Events, ",")
 		for _, event := range eventList {
 			event = strings.TrimSpace(event)
@@ -2954,6 +4689,83 @@ func (s *server) Respond(w http.ResponseWriter, r *http.Request, status int, dat
 	}
 }
 
+// Responds to a send request whose media was refused or could not be read.
+// Oversized media is reported as 413, media on non-public addresses as 400,
+// and any other error as 400 with fallback.
+func (s *server) respondMediaError(w http.ResponseWriter, r *http.Request, err error, fallback error) {
+	if status, mediaErr := mediaErrorStatus(err); status != 0 {
+		s.Respond(w, r, status, mediaErr)
+		return
+	}
+	s.Respond(w, r, http.StatusBadRequest, fallback)
+}
+
+// Writes downloaded media as a data URL in the JSON envelope
+func (s *server) respondDownload(w http.ResponseWriter, r *http.Request, data []byte, mimetype string) {
+	dataURL := dataurl.New(data, mimetype)
+	response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+	} else {
+		s.Respond(w, r, http.StatusOK, string(responseJson))
+	}
+}
+
+// Downloads media into a temporary file and serves it raw, so large files
+// are never held in memory. Nothing is written to w if download fails.
+func (s *server) respondRawDownload(w http.ResponseWriter, r *http.Request, mimetype string, name string, download func(file *os.File) error) error {
+	file, err := os.CreateTemp("", "wuzapi-media-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := download(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.RespondMedia(w, r, file, mimetype, name)
+	return nil
+}
+
+// Writes raw media to API clients, bypassing the JSON envelope.
+// Range requests are honored so large videos can be streamed by players.
+func (s *server) RespondMedia(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, mimetype string, name string) {
+	if mimetype == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(content, head)
+		mimetype = http.DetectContentType(head[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if exts, _ := mime.ExtensionsByType(mimetype); len(exts) > 0 {
+		name += exts[0]
+	}
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, time.Time{}, content)
+}
+
+// wantsRawMedia reports whether the client asked for the media bytes instead of a data URL
+func wantsRawMedia(r *http.Request) bool {
+	if raw, err := strconv.ParseBool(r.URL.Query().Get("raw")); err == nil && raw {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediatype == "application/octet-stream" {
+			return true
+		}
+	}
+	return false
+}
+
 func validateMessageFields(phone string, stanzaid *string, participant *string) (types.JID, error) {
 
 	recipient, ok := parseJID(phone)
@@ -2961,12 +4773,6 @@ func validateMessageFields(phone string, stanzaid *string, participant *string)
 		return types.NewJID("", types.DefaultUserServer), errors.New("could not parse Phone")
 	}
 
-	if stanzaid != nil {
-		if participant == nil {
-			return types.NewJID("", types.DefaultUserServer), errors.New("missing Participant in ContextInfo")
-		}
-	}
-
 	if participant != nil {
 		if stanzaid == nil {
 			return types.NewJID("", types.DefaultUserServer), errors.New("missing StanzaId in ContextInfo")
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Outcome of ingesting a history sync chunk, along with the totals of its
+// sync type so far. StoredMessages counts the messages that were not already
+// in the message store, FailedMessages those that could not be recorded.
+type historySyncSummary struct {
+	SyncType           string
+	ChunkOrder         uint32
+	Progress           uint32
+	Conversations      int
+	Messages           int
+	StoredMessages     int
+	FailedMessages     int
+	TotalChunks        int
+	TotalConversations int
+	TotalMessages      int
+
+	chats []historyChatResult
+}
+
+// Messages received for a single chat in a history sync chunk
+type historyChatResult struct {
+	JID            types.JID
+	Messages       int
+	StoredMessages int
+	OldestID       string
+}
+
+// Chat as recorded from history syncs and live messages. State fields left
+// nil keep their recorded value.
+type chatInfo struct {
+	JID           types.JID
+	Name          string
+	UnreadCount   *uint32
+	LastMessageAt time.Time
+	Archived      *bool
+	Pinned        *bool
+	MutedUntil    *time.Time
+}
+
+// Records the conversations of a history sync chunk in the chats table and,
+// when the message store is enabled, their messages in the message index
+// and store. Messages already known from live events are left untouched.
+// Failures are logged and skipped, so one bad chat or message does not stop
+// the rest of the chunk, and the progress is always recorded.
+func ingestHistorySync(client *whatsmeow.Client, db *sql.DB, userID int, data *waProto.HistorySync) (*historySyncSummary, error) {
+	summary := &historySyncSummary{
+		SyncType:   strings.ToLower(data.GetSyncType().String()),
+		ChunkOrder: data.GetChunkOrder(),
+		Progress:   data.GetProgress(),
+	}
+	storeEnabled := messageStoreEnabled(db, userID)
+	// Chunks asked for to load older messages only carry those messages,
+	// not the current state of the chat
+	onDemand := data.GetSyncType() == waProto.HistorySync_ON_DEMAND
+
+	for _, conv := range data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetId())
+		if err != nil {
+			log.Warn().Err(err).Str("chat", conv.GetId()).Msg("Skipping history of unparsable chat")
+			continue
+		}
+		summary.Conversations++
+
+		chat := chatInfo{
+			JID:           chatJID,
+			Name:          conv.GetName(),
+			LastMessageAt: time.Unix(int64(conv.GetConversationTimestamp()), 0),
+		}
+		if chat.Name == "" {
+			chat.Name = conv.GetDisplayName()
+		}
+		if !onDemand {
+			chat.UnreadCount, chat.Archived = conv.UnreadCount, conv.Archived
+			if conv.Pinned != nil {
+				pinned := conv.GetPinned() > 0
+				chat.Pinned = &pinned
+			}
+			if conv.MuteEndTime != nil {
+				mutedUntil := time.Unix(int64(conv.GetMuteEndTime()), 0)
+				chat.MutedUntil = &mutedUntil
+			}
+		}
+		if err := saveChat(db, userID, &chat); err != nil {
+			log.Error().Err(err).Str("chat", chatJID.String()).Msg("Failed to save chat from history")
+		}
+		if conv.EphemeralExpiration != nil {
+			if err := saveDisappearingTimer(db, userID, chatJID, conv.GetEphemeralExpiration()); err != nil {
+				log.Warn().Err(err).Str("chat", chatJID.String()).Msg("Failed to save disappearing timer from history")
+			}
+		}
+
+		result := historyChatResult{JID: chatJID, Messages: len(conv.GetMessages())}
+		var oldest uint64
+		for _, historyMsg := range conv.GetMessages() {
+			webMsg := historyMsg.GetMessage()
+			if ts := webMsg.GetMessageTimestamp(); result.OldestID == "" || ts < oldest {
+				result.OldestID, oldest = webMsg.GetKey().GetId(), ts
+			}
+		}
+		summary.Messages += result.Messages
+
+		for _, historyMsg := range conv.GetMessages() {
+			if !storeEnabled {
+				break
+			}
+			evt, err := client.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				log.Warn().Err(err).Str("chat", chatJID.String()).Msg("Skipping unparsable history message")
+				continue
+			}
+			if evt.Message == nil || evt.Message.ProtocolMessage != nil || evt.Message.ReactionMessage != nil {
+				continue
+			}
+			if err := indexMessage(db, userID, &evt.Info, evt.Message, storeEnabled); err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Str("chat", chatJID.String()).Msg("Failed to index message from history")
+			}
+			added, err := storeMessage(db, userID, &evt.Info, evt.Message)
+			if err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Str("chat", chatJID.String()).Msg("Failed to store message from history")
+				summary.FailedMessages++
+				continue
+			}
+			if added {
+				result.StoredMessages++
+			}
+		}
+		summary.StoredMessages += result.StoredMessages
+		summary.chats = append(summary.chats, result)
+	}
+
+	if err := saveHistorySyncProgress(db, userID, summary); err != nil {
+		return summary, fmt.Errorf("failed to save history sync progress: %w", err)
+	}
+	return summary, nil
+}
+
+// Records or updates a chat. Names and the last message time are only
+// replaced by newer information, and state fields only when they are set.
+func saveChat(db *sql.DB, userID int, chat *chatInfo) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, name, unread_count, last_message_at, archived, pinned, muted_until)
+			VALUES (?, ?, ?, COALESCE(?, 0), ?, COALESCE(?, FALSE), COALESCE(?, FALSE), COALESCE(?, 0))
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+				name = CASE WHEN excluded.name <> '' THEN excluded.name ELSE chats.name END,
+				unread_count = COALESCE(?, chats.unread_count),
+				last_message_at = MAX(chats.last_message_at, excluded.last_message_at),
+				archived = COALESCE(?, chats.archived), pinned = COALESCE(?, chats.pinned), muted_until = COALESCE(?, chats.muted_until)`
+	case "postgresql":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, name, unread_count, last_message_at, archived, pinned, muted_until)
+			VALUES ($1, $2, $3, COALESCE($4, 0), $5, COALESCE($6, FALSE), COALESCE($7, FALSE), COALESCE($8, 0))
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+				name = CASE WHEN excluded.name <> '' THEN excluded.name ELSE chats.name END,
+				unread_count = COALESCE($9, chats.unread_count),
+				last_message_at = GREATEST(chats.last_message_at, excluded.last_message_at),
+				archived = COALESCE($10, chats.archived), pinned = COALESCE($11, chats.pinned), muted_until = COALESCE($12, chats.muted_until)`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var mutedUntil *int64
+	if chat.MutedUntil != nil {
+		seconds := unixOrZero(*chat.MutedUntil)
+		mutedUntil = &seconds
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.JID.ToNonAD().String(), chat.Name, chat.UnreadCount, unixOrZero(chat.LastMessageAt),
+		chat.Archived, chat.Pinned, mutedUntil, chat.UnreadCount, chat.Archived, chat.Pinned, mutedUntil)
+	return err
+}
+
+// Moves the last message time of a chat forward, recording the chat if it
+// is new. Incoming messages add to the unread count, while messages sent
+// by the user mean the chat has been read.
+func touchChat(db *sql.DB, userID int, chat types.JID, timestamp time.Time, fromMe bool) error {
+	unread := 1
+	if fromMe {
+		unread = 0
+	}
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, last_message_at, unread_count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET last_message_at = MAX(chats.last_message_at, excluded.last_message_at),
+				unread_count = CASE WHEN excluded.unread_count = 0 THEN 0 ELSE chats.unread_count + 1 END`
+	case "postgresql":
+		sqlStmt = `INSERT INTO chats (user_id, chat_jid, last_message_at, unread_count) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, chat_jid) DO UPDATE SET last_message_at = GREATEST(chats.last_message_at, excluded.last_message_at),
+				unread_count = CASE WHEN excluded.unread_count = 0 THEN 0 ELSE chats.unread_count + 1 END`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.ToNonAD().String(), unixOrZero(timestamp), unread)
+	return err
+}
+
+// Adds a chunk to the progress of its sync type and fills the totals of
+// the summary
+func saveHistorySyncProgress(db *sql.DB, userID int, summary *historySyncSummary) error {
+	now := time.Now().Unix()
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`INSERT INTO history_sync (user_id, sync_type, chunks, conversations, messages, progress, updated_at)
+			VALUES (?, ?, 1, ?, ?, ?, ?)
+			ON CONFLICT (user_id, sync_type) DO UPDATE SET chunks = history_sync.chunks + 1,
+				conversations = history_sync.conversations + excluded.conversations,
+				messages = history_sync.messages + excluded.messages,
+				progress = MAX(history_sync.progress, excluded.progress), updated_at = excluded.updated_at
+			RETURNING chunks, conversations, messages, progress`,
+			userID, summary.SyncType, summary.Conversations, summary.Messages, summary.Progress, now)
+	case "postgresql":
+		row = db.QueryRow(`INSERT INTO history_sync (user_id, sync_type, chunks, conversations, messages, progress, updated_at)
+			VALUES ($1, $2, 1, $3, $4, $5, $6)
+			ON CONFLICT (user_id, sync_type) DO UPDATE SET chunks = history_sync.chunks + 1,
+				conversations = history_sync.conversations + excluded.conversations,
+				messages = history_sync.messages + excluded.messages,
+				progress = GREATEST(history_sync.progress, excluded.progress), updated_at = excluded.updated_at
+			RETURNING chunks, conversations, messages, progress`,
+			userID, summary.SyncType, summary.Conversations, summary.Messages, summary.Progress, now)
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return row.Scan(&summary.TotalChunks, &summary.TotalConversations, &summary.TotalMessages, &summary.Progress)
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return t.Unix()
+}
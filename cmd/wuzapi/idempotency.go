@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the result of a send is kept to answer repeated requests
+const idempotencyTTL = 24 * time.Hour
+
+// Longest idempotency key accepted
+const maxIdempotencyKeyLength = 255
+
+// Result of a request made with an idempotency key
+type idempotentResult struct {
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+}
+
+// Per key locks that serialize concurrent requests with the same key
+var (
+	idempotencyMutex sync.Mutex
+	idempotencyLocks = make(map[string]*idempotencyLock)
+)
+
+type idempotencyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func lockIdempotencyKey(name string) func() {
+	idempotencyMutex.Lock()
+	lock := idempotencyLocks[name]
+	if lock == nil {
+		lock = &idempotencyLock{}
+		idempotencyLocks[name] = lock
+	}
+	lock.refs++
+	idempotencyMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		idempotencyMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(idempotencyLocks, name)
+		}
+		idempotencyMutex.Unlock()
+	}
+}
+
+// Response writer that keeps a copy of what the handler writes
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// Middleware for send endpoints that makes retries safe. The key comes from
+// the Idempotency-Key header or else the Id field of a JSON payload, so
+// multipart uploads can only use the header. The first
+// successful response for a key is recorded and returned again to requests
+// repeating the key, without sending anything. Requests with the same key
+// wait for each other.
+func (s *server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		body, err := readJSONBody(w, r)
+		if err != nil {
+			s.respondMediaError(w, r, err, errors.New("could not read Payload"))
+			return
+		}
+
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" && body != nil {
+			var payload struct{ Id string }
+			if json.Unmarshal(body, &payload) == nil {
+				key = payload.Id
+			}
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("idempotency key can not be longer than %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		hash := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+
+		unlock := lockIdempotencyKey(txtid + ":" + key)
+		defer unlock()
+
+		result, err := getIdempotentResult(s.db, userid, key)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if result != nil {
+			if result.RequestHash != requestHash {
+				s.Respond(w, r, http.StatusUnprocessableEntity, errors.New("idempotency key was already used for a different request"))
+				return
+			}
+			log.Info().Str("key", key).Str("userid", txtid).Msg("Replaying response of repeated request")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(result.StatusCode)
+			w.Write(result.Response)
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		// Failed requests are not recorded so that they can be retried
+		if rw.status != http.StatusOK {
+			return
+		}
+		result = &idempotentResult{RequestHash: requestHash, StatusCode: rw.status, Response: rw.body.Bytes()}
+		if err := saveIdempotentResult(s.db, userid, key, result); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to save idempotent result")
+		}
+	})
+}
+
+// Returns the recorded result for a key, nil if there is none or it expired
+func getIdempotentResult(db *sql.DB, userID int, key string) (*idempotentResult, error) {
+	since := time.Now().Add(-idempotencyTTL).Unix()
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT request_hash, status_code, response FROM idempotency_keys
+			WHERE user_id = ? AND idempotency_key = ? AND created_at >= ?`, userID, key, since)
+	case "postgresql":
+		row = db.QueryRow(`SELECT request_hash, status_code, response FROM idempotency_keys
+			WHERE user_id = $1 AND idempotency_key = $2 AND created_at >= $3`, userID, key, since)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var result idempotentResult
+	if err := row.Scan(&result.RequestHash, &result.StatusCode, &result.Response); errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Records the result for a key, replacing an expired one, and drops the
+// other expired results of the user
+func saveIdempotentResult(db *sql.DB, userID int, key string, result *idempotentResult) error {
+	now := time.Now().Unix()
+	since := time.Now().Add(-idempotencyTTL).Unix()
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, status_code, response, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, idempotency_key) DO UPDATE SET request_hash = excluded.request_hash,
+				status_code = excluded.status_code, response = excluded.response, created_at = excluded.created_at`,
+			userID, key, result.RequestHash, result.StatusCode, result.Response, now)
+		if err == nil {
+			_, err = db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND created_at < ?`, userID, since)
+		}
+	case "postgresql":
+		_, err = db.Exec(`INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, status_code, response, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id, idempotency_key) DO UPDATE SET request_hash = excluded.request_hash,
+				status_code = excluded.status_code, response = excluded.response, created_at = excluded.created_at`,
+			userID, key, result.RequestHash, result.StatusCode, result.Response, now)
+		if err == nil {
+			_, err = db.Exec(`DELETE FROM idempotency_keys WHERE user_id = $1 AND created_at < $2`, userID, since)
+		}
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Limits applied when fetching pages to build link previews. Previews are
+// optional, so they are kept tight to avoid delaying the message.
+const (
+	previewTimeout       = 8 * time.Second
+	maxPreviewPageBytes  = 512 << 10
+	maxPreviewImageBytes = 5 << 20
+)
+
+// Matches the first http(s) URL in a text
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Title, description and thumbnail shown in the preview card of a link
+type linkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	Thumbnail   []byte
+}
+
+// Returns the first URL in text, without trailing punctuation
+func findURL(text string) string {
+	return strings.TrimRight(urlRegex.FindString(text), ".,;:!?)]}")
+}
+
+// Fetches a page and builds its preview from the Open Graph tags, falling
+// back to the title and description meta tag
+func fetchLinkPreview(ctx context.Context, pageURL string) (*linkPreview, error) {
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := mediaHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch page: %s", resp.Status)
+	}
+	if mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediatype != "text/html" && mediatype != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unsupported page type %s", mediatype)
+	}
+
+	preview := parsePreview(io.LimitReader(resp.Body, maxPreviewPageBytes))
+	preview.URL = pageURL
+	if preview.Title == "" {
+		return nil, errors.New("page has no title")
+	}
+
+	if preview.ImageURL != "" {
+		if imageURL, err := resp.Request.URL.Parse(preview.ImageURL); err == nil {
+			preview.ImageURL = imageURL.String()
+			if thumbnail, err := fetchPreviewThumbnail(ctx, preview.ImageURL); err == nil {
+				preview.Thumbnail = thumbnail
+			} else {
+				log.Warn().Err(err).Str("url", preview.ImageURL).Msg("Failed to fetch link preview image")
+			}
+		}
+	}
+	return preview, nil
+}
+
+// Reads the preview fields from the head of an HTML document
+func parsePreview(r io.Reader) *linkPreview {
+	preview := &linkPreview{}
+	var title, description string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return finishPreview(preview, title, description)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.Data {
+			case "body":
+				return finishPreview(preview, title, description)
+			case "title":
+				if z.Next() == html.TextToken {
+					title = strings.TrimSpace(z.Token().Data)
+				}
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if preview.ImageURL == "" {
+						preview.ImageURL = content
+					}
+				case "description":
+					description = content
+				}
+			}
+		case html.EndTagToken:
+			if z.Token().Data == "head" {
+				return finishPreview(preview, title, description)
+			}
+		}
+	}
+}
+
+func finishPreview(preview *linkPreview, title string, description string) *linkPreview {
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	return preview
+}
+
+// Downloads the preview image of a page and turns it into a JPEG thumbnail
+func fetchPreviewThumbnail(ctx context.Context, imageURL string) ([]byte, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("invalid image URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mediaHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch image: %s", resp.Status)
+	}
+	if resp.ContentLength > maxPreviewImageBytes {
+		return nil, errMediaTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPreviewImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPreviewImageBytes {
+		return nil, errMediaTooLarge
+	}
+
+	meta, err := getImageMeta(data)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Thumbnail, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Position to send in a location message. Static locations can be named and
+// carry an address, url and comment. Live locations are sent again with a
+// growing sequence number for as long as the position is shared. Latitude,
+// Longitude and Heading are pointers as 0 is a valid value for each of them.
+type locationFields struct {
+	Latitude       *float64
+	Longitude      *float64
+	Name           string
+	Address        string
+	Url            string
+	Comment        string
+	Live           bool
+	Accuracy       uint32
+	Speed          float32
+	Heading        *uint32
+	SequenceNumber int64
+	TimeOffset     uint32
+}
+
+func (l *locationFields) validate() error {
+	if l.Latitude == nil {
+		return errors.New("missing Latitude in Payload")
+	}
+	if l.Longitude == nil {
+		return errors.New("missing Longitude in Payload")
+	}
+	if *l.Latitude < -90 || *l.Latitude > 90 {
+		return errors.New("invalid Latitude, must be between -90 and 90")
+	}
+	if *l.Longitude < -180 || *l.Longitude > 180 {
+		return errors.New("invalid Longitude, must be between -180 and 180")
+	}
+	if l.Heading != nil && *l.Heading > 359 {
+		return errors.New("invalid Heading, must be between 0 and 359")
+	}
+	if l.Speed < 0 {
+		return errors.New("invalid Speed, can not be negative")
+	}
+	return nil
+}
+
+// Builds a location or live location message. Live locations without a
+// sequence number get the current time in milliseconds, so that every update
+// supersedes the previous one.
+func (l *locationFields) message() *waProto.Message {
+	optString := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return proto.String(s)
+	}
+	optUint32 := func(n uint32) *uint32 {
+		if n == 0 {
+			return nil
+		}
+		return proto.Uint32(n)
+	}
+	var speed *float32
+	if l.Speed > 0 {
+		speed = proto.Float32(l.Speed)
+	}
+
+	if l.Live {
+		sequence := l.SequenceNumber
+		if sequence == 0 {
+			sequence = time.Now().UnixMilli()
+		}
+		return &waProto.Message{LiveLocationMessage: &waProto.LiveLocationMessage{
+			DegreesLatitude:                   proto.Float64(*l.Latitude),
+			DegreesLongitude:                  proto.Float64(*l.Longitude),
+			AccuracyInMeters:                  optUint32(l.Accuracy),
+			SpeedInMps:                        speed,
+			DegreesClockwiseFromMagneticNorth: l.Heading,
+			Caption:                           optString(l.Comment),
+			SequenceNumber:                    proto.Int64(sequence),
+			TimeOffset:                        optUint32(l.TimeOffset),
+		}}
+	}
+
+	return &waProto.Message{LocationMessage: &waProto.LocationMessage{
+		DegreesLatitude:                   proto.Float64(*l.Latitude),
+		DegreesLongitude:                  proto.Float64(*l.Longitude),
+		Name:                              optString(l.Name),
+		Address:                           optString(l.Address),
+		Url:                               optString(l.Url),
+		Comment:                           optString(l.Comment),
+		AccuracyInMeters:                  optUint32(l.Accuracy),
+		SpeedInMps:                        speed,
+		DegreesClockwiseFromMagneticNorth: l.Heading,
+	}}
+}
+
+// Returns the fields of the LocationUpdate webhook for a live location
+// message, or nil if msg is not one. Older clients share live locations as
+// location messages flagged as live.
+func locationUpdate(msg *waProto.Message) map[string]interface{} {
+	if live := msg.GetLiveLocationMessage(); live != nil {
+		return map[string]interface{}{
+			"latitude":       live.GetDegreesLatitude(),
+			"longitude":      live.GetDegreesLongitude(),
+			"accuracy":       live.GetAccuracyInMeters(),
+			"speed":          live.GetSpeedInMps(),
+			"heading":        live.GetDegreesClockwiseFromMagneticNorth(),
+			"sequenceNumber": live.GetSequenceNumber(),
+			"timeOffset":     live.GetTimeOffset(),
+			"caption":        live.GetCaption(),
+		}
+	}
+	if location := msg.GetLocationMessage(); location.GetIsLive() {
+		return map[string]interface{}{
+			"latitude":       location.GetDegreesLatitude(),
+			"longitude":      location.GetDegreesLongitude(),
+			"accuracy":       location.GetAccuracyInMeters(),
+			"speed":          location.GetSpeedInMps(),
+			"heading":        location.GetDegreesClockwiseFromMagneticNorth(),
+			"sequenceNumber": int64(0),
+			"timeOffset":     uint32(0),
+			"caption":        location.GetComment(),
+		}
+	}
+	return nil
+}
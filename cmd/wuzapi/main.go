@@ -34,13 +34,14 @@ type server struct {
 var (
 	// Flags that can be set via command line
 
-	address    = flag.String("address", "0.0.0.0", "Bind IP Address")
-	port       = flag.String("port", "8080", "Listen Port")
-	waDebug    = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
-	logType    = flag.String("logtype", "console", "Type of log output (console or json)")
-	sslcert    = flag.String("sslcertificate", "", "SSL Certificate File")
-	sslprivkey = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
-	adminToken = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
+	address      = flag.String("address", "0.0.0.0", "Bind IP Address")
+	port         = flag.String("port", "8080", "Listen Port")
+	waDebug      = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
+	logType      = flag.String("logtype", "console", "Type of log output (console or json)")
+	sslcert      = flag.String("sslcertificate", "", "SSL Certificate File")
+	sslprivkey   = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	adminToken   = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
+	maxMediaSize = flag.Int64("maxmediasize", 64, "Maximum size in MB of media uploaded or fetched from URLs")
 
 	configFile  = flag.String("config", "/etc/wuzapi/config", "Path to the configuration file")
 	postgresCfg = flag.String("postgresconfig", "/etc/wuzapi/postgres_config", "Path to the PostgreSQL configuration file")
@@ -83,8 +84,6 @@ func ParseConfigFile(filename string) (Config, error) {
 }
 
 func init() {
-	flag.Parse()
-
 	// Set up logging to file
 	logPath := "/var/log/wuzapi/wuzapi.log"
 	if os.Getenv("WUZAPI_LOG_PATH") != "" {
@@ -102,6 +101,8 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
+
 	ex, err := os.Executable()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to get executable path")
@@ -168,6 +169,10 @@ func main() {
 	}
 	//	defer appDB.Close()
 
+	if err := initAppTables(appDB); err != nil {
+		log.Fatal().Err(err).Msg("Could not initialize application tables")
+	}
+
 	s := &server{
 		router: mux.NewRouter(),
 		db:     appDB,
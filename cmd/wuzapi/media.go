@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+// Media resolved from a data URL, a http(s) URL or a multipart upload
+type mediaData struct {
+	Data     []byte
+	Mimetype string
+	FileName string
+}
+
+var errMediaTooLarge = errors.New("media exceeds maximum allowed size")
+
+// HTTP client used to fetch media from URLs supplied by API callers. It
+// refuses to connect to non-public addresses so the send endpoints cannot be
+// used to probe the internal network.
+var mediaHttpClient = &http.Client{
+	Timeout: 60 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: denyInternalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       60 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+var errMediaAddressDenied = errors.New("media URL points to a non-public address")
+
+// Address ranges media is never fetched from: "this network", private,
+// shared (CGNAT), loopback, link-local, protocol assignments, documentation,
+// benchmarking, multicast and reserved ranges
+var deniedMediaPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// IPv6 prefixes embedding an IPv4 address, which is checked in its place
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// Reports whether media must not be fetched from ip
+func isDeniedMediaAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if nat64Prefix.Contains(ip) {
+		b := ip.As16()
+		ip = netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+	} else if sixToFour.Contains(ip) {
+		b := ip.As16()
+		ip = netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]})
+	}
+	for _, prefix := range deniedMediaPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dialer hook rejecting connections to non public addresses
+func denyInternalAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("invalid address %s", host)
+	}
+	if isDeniedMediaAddress(ip) {
+		return fmt.Errorf("%w (%s)", errMediaAddressDenied, ip)
+	}
+	return nil
+}
+
+// Status code and client facing error for media that was refused, or 0 if
+// err is not about the media itself
+func mediaErrorStatus(err error) (int, error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errMediaTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, errMediaTooLarge
+	case errors.Is(err, errMediaAddressDenied):
+		return http.StatusBadRequest, errMediaAddressDenied
+	}
+	return 0, nil
+}
+
+// Maximum size in bytes of media accepted from callers
+func maxMediaBytes() int64 {
+	return *maxMediaSize << 20
+}
+
+// Room for the fields of a request besides its media
+const payloadFieldsBytes = 1 << 20
+
+// Maximum size of a JSON request. Media sent inline as a base64 data URL
+// is a third larger than the file.
+func maxJSONBodyBytes() int64 {
+	return maxMediaBytes()/3*4 + 4 + payloadFieldsBytes
+}
+
+// Maximum size of a multipart/form-data request
+func maxMultipartBodyBytes() int64 {
+	return maxMediaBytes() + payloadFieldsBytes
+}
+
+// Fetches media from a http(s) URL
+func fetchMedia(ctx context.Context, mediaURL string) (*mediaData, error) {
+	u, err := url.Parse(mediaURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid media URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mediaHttpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch media: %s", resp.Status)
+	}
+	if resp.ContentLength > maxMediaBytes() {
+		return nil, errMediaTooLarge
+	}
+
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	fileName := path.Base(resp.Request.URL.Path)
+	if fileName == "/" || fileName == "." {
+		fileName = ""
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		fileName = params["filename"]
+	}
+
+	return &mediaData{
+		Data:     data,
+		Mimetype: sniffMimetype(data, declared, fileName),
+		FileName: fileName,
+	}, nil
+}
+
+// Reads at most the maximum media size from r
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxMediaBytes()+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	}
+	if int64(len(data)) > maxMediaBytes() {
+		return nil, errMediaTooLarge
+	}
+	return data, nil
+}
+
+// Resolves a media payload field, which can be a base64 data URL or a http(s) URL
+func resolveMedia(ctx context.Context, value string) (*mediaData, error) {
+	switch {
+	case strings.HasPrefix(value, "data:"):
+		dataURL, err := dataurl.DecodeString(value)
+		if err != nil {
+			return nil, errors.New("could not decode base64 encoded data from payload")
+		}
+		if int64(len(dataURL.Data)) > maxMediaBytes() {
+			return nil, errMediaTooLarge
+		}
+		return &mediaData{
+			Data:     dataURL.Data,
+			Mimetype: sniffMimetype(dataURL.Data, dataURL.MediaType.ContentType(), ""),
+		}, nil
+	case strings.HasPrefix(value, "http://"), strings.HasPrefix(value, "https://"):
+		return fetchMedia(ctx, value)
+	default:
+		return nil, errors.New("media should be a base64 data URL (\"data:mime/type;base64,...\") or a http(s) URL")
+	}
+}
+
+// Returns the uploaded file if there is one, otherwise resolves the payload field
+func getMedia(r *http.Request, upload *mediaData, value string) (*mediaData, error) {
+	if upload != nil {
+		return upload, nil
+	}
+	return resolveMedia(r.Context(), value)
+}
+
+// Detects the mime type of data. The declared type or the file extension
+// are only used when the content itself is not recognized.
+func sniffMimetype(data []byte, declared string, fileName string) string {
+	sniffed := http.DetectContentType(data)
+	generic := sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain")
+	if !generic {
+		return sniffed
+	}
+	if declared != "" && declared != "application/octet-stream" {
+		return declared
+	}
+	if ext := path.Ext(fileName); ext != "" {
+		if byExt := mime.TypeByExtension(ext); byExt != "" {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// A request body already read into memory
+type bufferedBody struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (b *bufferedBody) Close() error { return nil }
+
+// Reads the JSON body of a request, up to the maximum JSON size, and puts
+// it back for the handler. The body is read once, so the send middlewares
+// share it. Multipart uploads are left unread and nil is returned.
+func readJSONBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if isMultipartRequest(r) {
+		return nil, nil
+	}
+	if buffered, ok := r.Body.(*bufferedBody); ok {
+		r.Body = &bufferedBody{Reader: bytes.NewReader(buffered.data), data: buffered.data}
+		return buffered.data, nil
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes()))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = &bufferedBody{Reader: bytes.NewReader(data), data: data}
+	return data, nil
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == "multipart/form-data"
+}
+
+// Parses a multipart/form-data request, which can be no larger than the
+// media it carries plus its other fields. Parts beyond 32 MiB are kept in
+// temporary files.
+func parseMultipartPayload(w http.ResponseWriter, r *http.Request) error {
+	if r.MultipartForm == nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMultipartBodyBytes())
+	}
+	return r.ParseMultipartForm(32 << 20)
+}
+
+// Decodes a send request from either a JSON body or a multipart/form-data
+// upload. For multipart requests the form fields fill t, and the file sent
+// in fileField is returned as the media.
+func decodePayload(w http.ResponseWriter, r *http.Request, t interface{}, fileField string) (*mediaData, error) {
+	if !isMultipartRequest(r) {
+		body := r.Body
+		if _, ok := body.(*bufferedBody); !ok {
+			body = http.MaxBytesReader(w, body, maxJSONBodyBytes())
+		}
+		return nil, json.NewDecoder(body).Decode(t)
+	}
+
+	if err := parseMultipartPayload(w, r); err != nil {
+		return nil, err
+	}
+	if err := decodeForm(r.MultipartForm.Value, t); err != nil {
+		return nil, err
+	}
+
+	file, header, err := r.FormFile(fileField)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := readLimited(file)
+	if err != nil {
+		return nil, err
+	}
+	declared, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	return &mediaData{
+		Data:     data,
+		Mimetype: sniffMimetype(data, declared, header.Filename),
+		FileName: header.Filename,
+	}, nil
+}
+
+// Copies form values into the matching struct fields of t. String fields
+// are set verbatim, any other field is parsed as JSON.
+func decodeForm(values map[string][]string, t interface{}) error {
+	v := reflect.ValueOf(t).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := ""
+		for key, vals := range values {
+			if strings.EqualFold(key, field.Name) && len(vals) > 0 {
+				value = vals[0]
+				break
+			}
+		}
+		if value == "" {
+			continue
+		}
+		if field.Type.Kind() == reflect.String {
+			v.Field(i).SetString(value)
+			continue
+		}
+		if err := json.Unmarshal([]byte(value), v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", field.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Delivery status of stored messages
+const (
+	statusSent     = "sent"
+	statusReceived = "received"
+)
+
+// Page sizes of the chat history query
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+var (
+	errMessageNotStored = errors.New("message not found")
+	errInvalidCursor    = errors.New("invalid cursor")
+)
+
+// Media attached to a stored message. The media itself is not kept, it can
+// be downloaded through /chat/download while the message is indexed.
+type storedMedia struct {
+	Type       string
+	Mimetype   string `json:",omitempty"`
+	FileName   string `json:",omitempty"`
+	FileLength uint64 `json:",omitempty"`
+	Seconds    uint32 `json:",omitempty"`
+	Width      uint32 `json:",omitempty"`
+	Height     uint32 `json:",omitempty"`
+}
+
+// Message as kept in the message store
+type storedMessage struct {
+	Id        string
+	Chat      string
+	Sender    string
+	PushName  string `json:",omitempty"`
+	FromMe    bool
+	Timestamp time.Time
+	Type      string
+	Body      string
+	Media     *storedMedia `json:",omitempty"`
+	QuotedId  string       `json:",omitempty"`
+	Status    string
+	Edited    bool
+	Revoked   bool
+}
+
+// Whether the message store is enabled, cached per user to avoid a query
+// for every message
+var messageStoreUsers sync.Map
+
+// Reports whether messages of a user are kept in the message store
+func messageStoreEnabled(db *sql.DB, userID int) bool {
+	if enabled, ok := messageStoreUsers.Load(userID); ok {
+		return enabled.(bool)
+	}
+
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT store_messages FROM user_settings WHERE user_id = ?`, userID)
+	case "postgresql":
+		row = db.QueryRow(`SELECT store_messages FROM user_settings WHERE user_id = $1`, userID)
+	default:
+		return false
+	}
+	var enabled bool
+	err := row.Scan(&enabled)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Int("userid", userID).Msg("Failed to read message store setting")
+		return false
+	}
+	messageStoreUsers.Store(userID, enabled)
+	return enabled
+}
+
+// Turns the message store of a user on or off. Stored messages are kept when
+// it is turned off.
+func setMessageStoreEnabled(db *sql.DB, userID int, enabled bool) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO user_settings (user_id, store_messages) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET store_messages=excluded.store_messages`
+	case "postgresql":
+		sqlStmt = `INSERT INTO user_settings (user_id, store_messages) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET store_messages=excluded.store_messages`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if _, err := db.Exec(sqlStmt, userID, enabled); err != nil {
+		return err
+	}
+	messageStoreUsers.Store(userID, enabled)
+	return nil
+}
+
+// Returns the normalized type of a message
+func messageType(msg *waProto.Message) string {
+	switch {
+	case msg.Conversation != nil, msg.ExtendedTextMessage != nil:
+		return "text"
+	case msg.ImageMessage != nil:
+		return "image"
+	case msg.VideoMessage != nil:
+		if msg.VideoMessage.GetGifPlayback() {
+			return "gif"
+		}
+		return "video"
+	case msg.AudioMessage != nil:
+		if msg.AudioMessage.GetPtt() {
+			return "voice"
+		}
+		return "audio"
+	case msg.DocumentMessage != nil:
+		return "document"
+	case msg.StickerMessage != nil:
+		return "sticker"
+	case msg.LocationMessage != nil:
+		return "location"
+	case msg.LiveLocationMessage != nil:
+		return "live_location"
+	case msg.ContactMessage != nil, msg.ContactsArrayMessage != nil:
+		return "contact"
+	case getPollCreation(msg) != nil:
+		return "poll"
+	case msg.ButtonsMessage != nil, msg.ListMessage != nil, msg.TemplateMessage != nil:
+		return "interactive"
+	case msg.ButtonsResponseMessage != nil, msg.ListResponseMessage != nil, msg.TemplateButtonReplyMessage != nil:
+		return "response"
+	}
+	return "unknown"
+}
+
+// Returns the text that best represents a message: its text or caption,
+// the name of a location, contact or poll, or the selected reply
+func messageBody(msg *waProto.Message) string {
+	if text := messageText(msg); text != "" {
+		return text
+	}
+	switch {
+	case msg.LocationMessage != nil:
+		return strings.TrimSpace(msg.LocationMessage.GetName() + "\n" + msg.LocationMessage.GetAddress())
+	case msg.LiveLocationMessage != nil:
+		return msg.LiveLocationMessage.GetCaption()
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.GetDisplayName()
+	case msg.ContactsArrayMessage != nil:
+		return msg.ContactsArrayMessage.GetDisplayName()
+	case getPollCreation(msg) != nil:
+		return getPollCreation(msg).GetName()
+	case msg.ButtonsMessage != nil:
+		return msg.ButtonsMessage.GetContentText()
+	case msg.ListMessage != nil:
+		return msg.ListMessage.GetDescription()
+	case msg.ButtonsResponseMessage != nil:
+		return msg.ButtonsResponseMessage.GetSelectedDisplayText()
+	case msg.ListResponseMessage != nil:
+		return msg.ListResponseMessage.GetTitle()
+	case msg.TemplateButtonReplyMessage != nil:
+		return msg.TemplateButtonReplyMessage.GetSelectedDisplayText()
+	}
+	return ""
+}
+
+// Describes the media of a message, nil if it has none
+func messageMedia(msg *waProto.Message) *storedMedia {
+	switch {
+	case msg.ImageMessage != nil:
+		m := msg.ImageMessage
+		return &storedMedia{Type: "image", Mimetype: m.GetMimetype(), FileLength: m.GetFileLength(), Width: m.GetWidth(), Height: m.GetHeight()}
+	case msg.VideoMessage != nil:
+		m := msg.VideoMessage
+		return &storedMedia{Type: "video", Mimetype: m.GetMimetype(), FileLength: m.GetFileLength(), Seconds: m.GetSeconds(), Width: m.GetWidth(), Height: m.GetHeight()}
+	case msg.AudioMessage != nil:
+		m := msg.AudioMessage
+		return &storedMedia{Type: "audio", Mimetype: m.GetMimetype(), FileLength: m.GetFileLength(), Seconds: m.GetSeconds()}
+	case msg.DocumentMessage != nil:
+		m := msg.DocumentMessage
+		return &storedMedia{Type: "document", Mimetype: m.GetMimetype(), FileName: m.GetFileName(), FileLength: m.GetFileLength()}
+	case msg.StickerMessage != nil:
+		m := msg.StickerMessage
+		return &storedMedia{Type: "sticker", Mimetype: m.GetMimetype(), FileLength: m.GetFileLength(), Width: m.GetWidth(), Height: m.GetHeight()}
+	}
+	return nil
+}
+
+// Keeps a message in the message store. Callers check that the store is
+// enabled for the user. Messages already stored are left as they are. Returns
+// whether the message was added.
+func storeMessage(db *sql.DB, userID int, info *types.MessageInfo, msg *waProto.Message) (bool, error) {
+	media := ""
+	if m := messageMedia(msg); m != nil {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return false, err
+		}
+		media = string(data)
+	}
+	status := statusReceived
+	if info.IsFromMe {
+		status = statusSent
+	}
+
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO messages (user_id, chat_jid, message_id, sender_jid, push_name, from_me, timestamp, type, body, media, quoted_id, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, chat_jid, message_id) DO NOTHING`
+	case "postgresql":
+		sqlStmt = `INSERT INTO messages (user_id, chat_jid, message_id, sender_jid, push_name, from_me, timestamp, type, body, media, quoted_id, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (user_id, chat_jid, message_id) DO NOTHING`
+	default:
+		return false, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	result, err := db.Exec(sqlStmt, userID, info.Chat.ToNonAD().String(), info.ID, info.Sender.ToNonAD().String(), info.PushName, info.IsFromMe,
+		info.Timestamp.Unix(), messageType(msg), messageBody(msg), media, getContextInfo(msg).GetStanzaId(), status)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+// Applies an edit or revoke to the stored copy of the target message
+func storeProtocolMessage(db *sql.DB, userID int, chat types.JID, protocolMsg *waProto.ProtocolMessage) error {
+	chatJID, id := chat.ToNonAD().String(), protocolMsg.GetKey().GetId()
+
+	var err error
+	switch protocolMsg.GetType() {
+	case waProto.ProtocolMessage_MESSAGE_EDIT:
+		body := messageBody(protocolMsg.GetEditedMessage())
+		switch dbType {
+		case "sqlite3":
+			_, err = db.Exec(`UPDATE messages SET body = ?, edited = ? WHERE user_id = ? AND chat_jid = ? AND message_id = ?`, body, true, userID, chatJID, id)
+		case "postgresql":
+			_, err = db.Exec(`UPDATE messages SET body = $1, edited = $2 WHERE user_id = $3 AND chat_jid = $4 AND message_id = $5`, body, true, userID, chatJID, id)
+		default:
+			return fmt.Errorf("unsupported database type: %s", dbType)
+		}
+	case waProto.ProtocolMessage_REVOKE:
+		switch dbType {
+		case "sqlite3":
+			_, err = db.Exec(`UPDATE messages SET body = '', media = '', revoked = ? WHERE user_id = ? AND chat_jid = ? AND message_id = ?`, true, userID, chatJID, id)
+		case "postgresql":
+			_, err = db.Exec(`UPDATE messages SET body = '', media = '', revoked = $1 WHERE user_id = $2 AND chat_jid = $3 AND message_id = $4`, true, userID, chatJID, id)
+		default:
+			return fmt.Errorf("unsupported database type: %s", dbType)
+		}
+	}
+	return err
+}
+
+const storedMessageColumns = `chat_jid, message_id, sender_jid, push_name, from_me, timestamp, type, body, media, quoted_id, status, edited, revoked`
+
+func scanStoredMessage(scan func(dest ...interface{}) error) (*storedMessage, error) {
+	var m storedMessage
+	var timestamp int64
+	var media string
+	err := scan(&m.Chat, &m.Id, &m.Sender, &m.PushName, &m.FromMe, &timestamp, &m.Type, &m.Body, &media, &m.QuotedId, &m.Status, &m.Edited, &m.Revoked)
+	if err != nil {
+		return nil, err
+	}
+	m.Timestamp = time.Unix(timestamp, 0)
+	if media != "" {
+		m.Media = &storedMedia{}
+		if err := json.Unmarshal([]byte(media), m.Media); err != nil {
+			return nil, fmt.Errorf("invalid media stored for message: %w", err)
+		}
+	}
+	return &m, nil
+}
+
+// Looks up a stored message. Chat may be empty, in which case the most
+// recent message with that ID is returned.
+func getStoredMessage(db *sql.DB, userID int, chat string, id string) (*storedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		if chat == "" {
+			row = db.QueryRow(`SELECT `+storedMessageColumns+` FROM messages
+				WHERE user_id = ? AND message_id = ? ORDER BY timestamp DESC LIMIT 1`, userID, id)
+		} else {
+			row = db.QueryRow(`SELECT `+storedMessageColumns+` FROM messages
+				WHERE user_id = ? AND chat_jid = ? AND message_id = ? LIMIT 1`, userID, chat, id)
+		}
+	case "postgresql":
+		if chat == "" {
+			row = db.QueryRow(`SELECT `+storedMessageColumns+` FROM messages
+				WHERE user_id = $1 AND message_id = $2 ORDER BY timestamp DESC LIMIT 1`, userID, id)
+		} else {
+			row = db.QueryRow(`SELECT `+storedMessageColumns+` FROM messages
+				WHERE user_id = $1 AND chat_jid = $2 AND message_id = $3 LIMIT 1`, userID, chat, id)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	m, err := scanStoredMessage(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errMessageNotStored
+	}
+	return m, err
+}
+
+// Returns the stored messages of a chat, newest first, starting after the
+// given cursor. The returned cursor is empty on the last page.
+func getStoredMessages(db *sql.DB, userID int, chat string, cursor string, limit int) ([]storedMessage, string, error) {
+	// Without a cursor the page starts after every possible message
+	timestamp, id := int64(math.MaxInt64), ""
+	if cursor != "" {
+		var err error
+		timestamp, id, err = decodeHistoryCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT `+storedMessageColumns+` FROM messages
+			WHERE user_id = ? AND chat_jid = ? AND (timestamp < ? OR (timestamp = ? AND message_id < ?))
+			ORDER BY timestamp DESC, message_id DESC LIMIT ?`, userID, chat, timestamp, timestamp, id, limit+1)
+	case "postgresql":
+		rows, err = db.Query(`SELECT `+storedMessageColumns+` FROM messages
+			WHERE user_id = $1 AND chat_jid = $2 AND (timestamp < $3 OR (timestamp = $4 AND message_id < $5))
+			ORDER BY timestamp DESC, message_id DESC LIMIT $6`, userID, chat, timestamp, timestamp, id, limit+1)
+	default:
+		return nil, "", fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	messages := []storedMessage{}
+	for rows.Next() {
+		m, err := scanStoredMessage(rows.Scan)
+		if err != nil {
+			return nil, "", err
+		}
+		messages = append(messages, *m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(messages) > limit {
+		messages = messages[:limit]
+		last := messages[limit-1]
+		next = encodeHistoryCursor(last.Timestamp.Unix(), last.Id)
+	}
+	return messages, next, nil
+}
+
+// Cursors point to the last message of a page, by timestamp and ID
+func encodeHistoryCursor(timestamp int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", timestamp, id)))
+}
+
+func decodeHistoryCursor(cursor string) (int64, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", errInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return 0, "", errInvalidCursor
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return 0, "", errInvalidCursor
+	}
+	return timestamp, id, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Application tables created on startup, besides the users table that is
+// provisioned by the installer. Statements must be idempotent.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS message_index (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sender_jid TEXT NOT NULL DEFAULT '',
+		from_me BOOLEAN NOT NULL DEFAULT 0,
+		is_group BOOLEAN NOT NULL DEFAULT 0,
+		media_type TEXT NOT NULL DEFAULT '',
+		timestamp INTEGER NOT NULL DEFAULT 0,
+		message BLOB,
+		PRIMARY KEY (user_id, chat_jid, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_index_id ON message_index(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS poll_votes (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		poll_id TEXT NOT NULL,
+		voter_jid TEXT NOT NULL,
+		options TEXT NOT NULL DEFAULT '[]',
+		timestamp INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid, poll_id, voter_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_settings (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		disappearing_timer INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_settings (
+		user_id INTEGER PRIMARY KEY,
+		store_messages BOOLEAN NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sender_jid TEXT NOT NULL DEFAULT '',
+		push_name TEXT NOT NULL DEFAULT '',
+		from_me BOOLEAN NOT NULL DEFAULT 0,
+		timestamp INTEGER NOT NULL DEFAULT 0,
+		type TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		media TEXT NOT NULL DEFAULT '',
+		quoted_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '',
+		edited BOOLEAN NOT NULL DEFAULT 0,
+		revoked BOOLEAN NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_chat_time ON messages(user_id, chat_jid, timestamp, message_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_id ON messages(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS chats (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		unread_count INTEGER NOT NULL DEFAULT 0,
+		last_message_at INTEGER NOT NULL DEFAULT 0,
+		archived BOOLEAN NOT NULL DEFAULT 0,
+		pinned BOOLEAN NOT NULL DEFAULT 0,
+		muted_until INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS history_sync (
+		user_id INTEGER NOT NULL,
+		sync_type TEXT NOT NULL,
+		chunks INTEGER NOT NULL DEFAULT 0,
+		conversations INTEGER NOT NULL DEFAULT 0,
+		messages INTEGER NOT NULL DEFAULT 0,
+		progress INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, sync_type)
+	)`,
+	`CREATE TABLE IF NOT EXISTS backfill_jobs (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		before_id TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		messages INTEGER NOT NULL DEFAULT 0,
+		stored_messages INTEGER NOT NULL DEFAULT 0,
+		oldest_id TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_backfill_jobs_chat ON backfill_jobs(user_id, chat_jid, status)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_index_chat_time ON message_index(user_id, chat_jid, timestamp)`,
+	`CREATE TABLE IF NOT EXISTS message_status (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		participant_jid TEXT NOT NULL DEFAULT '',
+		sent_at INTEGER NOT NULL DEFAULT 0,
+		server_ack_at INTEGER NOT NULL DEFAULT 0,
+		delivered_at INTEGER NOT NULL DEFAULT 0,
+		read_at INTEGER NOT NULL DEFAULT 0,
+		played_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid, message_id, participant_jid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_status_id ON message_status(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		response BLOB,
+		created_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, idempotency_key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS queue_settings (
+		user_id INTEGER PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT 0,
+		per_minute INTEGER NOT NULL DEFAULT 20,
+		jitter_seconds INTEGER NOT NULL DEFAULT 5,
+		typing BOOLEAN NOT NULL DEFAULT 1,
+		daily_cap INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS send_queue (
+		user_id INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT '',
+		message BLOB,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL DEFAULT 0,
+		sent_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_send_queue_status ON send_queue(user_id, status, created_at)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		user_id INTEGER NOT NULL,
+		schedule_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT '',
+		message BLOB,
+		send_at INTEGER NOT NULL DEFAULT 0,
+		cron TEXT NOT NULL DEFAULT '',
+		timezone TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		next_run INTEGER NOT NULL DEFAULT 0,
+		last_run INTEGER NOT NULL DEFAULT 0,
+		last_message_id TEXT NOT NULL DEFAULT '',
+		last_status TEXT NOT NULL DEFAULT '',
+		last_error TEXT NOT NULL DEFAULT '',
+		runs INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, schedule_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_next_run ON scheduled_messages(user_id, status, next_run)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_media (
+		user_id INTEGER NOT NULL,
+		schedule_id TEXT NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (user_id, schedule_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS broadcasts (
+		user_id INTEGER NOT NULL,
+		broadcast_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		status TEXT NOT NULL,
+		per_minute INTEGER NOT NULL DEFAULT 20,
+		jitter_seconds INTEGER NOT NULL DEFAULT 5,
+		typing BOOLEAN NOT NULL DEFAULT 1,
+		created_at INTEGER NOT NULL DEFAULT 0,
+		finished_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, broadcast_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcasts_status ON broadcasts(user_id, status, created_at)`,
+	`CREATE TABLE IF NOT EXISTS broadcast_recipients (
+		user_id INTEGER NOT NULL,
+		broadcast_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		phone TEXT NOT NULL,
+		variables TEXT NOT NULL DEFAULT '{}',
+		jid TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		sent_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, broadcast_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_status ON broadcast_recipients(user_id, broadcast_id, status, position)`,
+	`CREATE TABLE IF NOT EXISTS message_templates (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, name, version)
+	)`,
+}
+
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS message_index (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sender_jid TEXT NOT NULL DEFAULT '',
+		from_me BOOLEAN NOT NULL DEFAULT FALSE,
+		is_group BOOLEAN NOT NULL DEFAULT FALSE,
+		media_type TEXT NOT NULL DEFAULT '',
+		timestamp BIGINT NOT NULL DEFAULT 0,
+		message BYTEA,
+		PRIMARY KEY (user_id, chat_jid, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_index_id ON message_index(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS poll_votes (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		poll_id TEXT NOT NULL,
+		voter_jid TEXT NOT NULL,
+		options TEXT NOT NULL DEFAULT '[]',
+		timestamp BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid, poll_id, voter_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_settings (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		disappearing_timer INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_settings (
+		user_id INTEGER PRIMARY KEY,
+		store_messages BOOLEAN NOT NULL DEFAULT FALSE
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sender_jid TEXT NOT NULL DEFAULT '',
+		push_name TEXT NOT NULL DEFAULT '',
+		from_me BOOLEAN NOT NULL DEFAULT FALSE,
+		timestamp BIGINT NOT NULL DEFAULT 0,
+		type TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		media TEXT NOT NULL DEFAULT '',
+		quoted_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '',
+		edited BOOLEAN NOT NULL DEFAULT FALSE,
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (user_id, chat_jid, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_chat_time ON messages(user_id, chat_jid, timestamp, message_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_id ON messages(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS chats (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		unread_count INTEGER NOT NULL DEFAULT 0,
+		last_message_at BIGINT NOT NULL DEFAULT 0,
+		archived BOOLEAN NOT NULL DEFAULT FALSE,
+		pinned BOOLEAN NOT NULL DEFAULT FALSE,
+		muted_until BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS history_sync (
+		user_id INTEGER NOT NULL,
+		sync_type TEXT NOT NULL,
+		chunks INTEGER NOT NULL DEFAULT 0,
+		conversations INTEGER NOT NULL DEFAULT 0,
+		messages INTEGER NOT NULL DEFAULT 0,
+		progress INTEGER NOT NULL DEFAULT 0,
+		updated_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, sync_type)
+	)`,
+	`CREATE TABLE IF NOT EXISTS backfill_jobs (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		before_id TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		messages INTEGER NOT NULL DEFAULT 0,
+		stored_messages INTEGER NOT NULL DEFAULT 0,
+		oldest_id TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL DEFAULT 0,
+		updated_at BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_backfill_jobs_chat ON backfill_jobs(user_id, chat_jid, status)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_index_chat_time ON message_index(user_id, chat_jid, timestamp)`,
+	`CREATE TABLE IF NOT EXISTS message_status (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		participant_jid TEXT NOT NULL DEFAULT '',
+		sent_at BIGINT NOT NULL DEFAULT 0,
+		server_ack_at BIGINT NOT NULL DEFAULT 0,
+		delivered_at BIGINT NOT NULL DEFAULT 0,
+		read_at BIGINT NOT NULL DEFAULT 0,
+		played_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, chat_jid, message_id, participant_jid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_status_id ON message_status(user_id, message_id)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		response BYTEA,
+		created_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, idempotency_key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS queue_settings (
+		user_id INTEGER PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		per_minute INTEGER NOT NULL DEFAULT 20,
+		jitter_seconds INTEGER NOT NULL DEFAULT 5,
+		typing BOOLEAN NOT NULL DEFAULT TRUE,
+		daily_cap INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS send_queue (
+		user_id INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT '',
+		message BYTEA,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL DEFAULT 0,
+		sent_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, message_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_send_queue_status ON send_queue(user_id, status, created_at)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		user_id INTEGER NOT NULL,
+		schedule_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT '',
+		message BYTEA,
+		send_at BIGINT NOT NULL DEFAULT 0,
+		cron TEXT NOT NULL DEFAULT '',
+		timezone TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		next_run BIGINT NOT NULL DEFAULT 0,
+		last_run BIGINT NOT NULL DEFAULT 0,
+		last_message_id TEXT NOT NULL DEFAULT '',
+		last_status TEXT NOT NULL DEFAULT '',
+		last_error TEXT NOT NULL DEFAULT '',
+		runs INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, schedule_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_next_run ON scheduled_messages(user_id, status, next_run)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_media (
+		user_id INTEGER NOT NULL,
+		schedule_id TEXT NOT NULL,
+		data BYTEA NOT NULL,
+		PRIMARY KEY (user_id, schedule_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS broadcasts (
+		user_id INTEGER NOT NULL,
+		broadcast_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		status TEXT NOT NULL,
+		per_minute INTEGER NOT NULL DEFAULT 20,
+		jitter_seconds INTEGER NOT NULL DEFAULT 5,
+		typing BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at BIGINT NOT NULL DEFAULT 0,
+		finished_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, broadcast_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcasts_status ON broadcasts(user_id, status, created_at)`,
+	`CREATE TABLE IF NOT EXISTS broadcast_recipients (
+		user_id INTEGER NOT NULL,
+		broadcast_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		phone TEXT NOT NULL,
+		variables TEXT NOT NULL DEFAULT '{}',
+		jid TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		sent_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, broadcast_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_status ON broadcast_recipients(user_id, broadcast_id, status, position)`,
+	`CREATE TABLE IF NOT EXISTS message_templates (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		created_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, name, version)
+	)`,
+}
+
+// Creates the application tables that are missing in the database
+func initAppTables(db *sql.DB) error {
+	var migrations []string
+	switch dbType {
+	case "sqlite3":
+		migrations = sqliteMigrations
+	case "postgresql":
+		migrations = postgresMigrations
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to run migration: %w", err)
+		}
+	}
+	return nil
+}
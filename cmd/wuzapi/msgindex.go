@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long to wait for the sender's phone to answer a media re-upload request
+const mediaRetryTimeout = 60 * time.Second
+
+// Index entries older than this are removed
+const messageIndexRetention = 90 * 24 * time.Hour
+
+var (
+	errMessageNotIndexed  = errors.New("message not found in index")
+	errMessageContentGone = errors.New("message content is not kept, enable the message store to forward it")
+)
+
+// Message as kept in the local message index
+type indexedMessage struct {
+	ID        string
+	Chat      types.JID
+	Sender    types.JID
+	FromMe    bool
+	IsGroup   bool
+	MediaType string
+	Timestamp time.Time
+	Message   *waProto.Message
+}
+
+// Builds the MessageInfo needed by whatsmeow to address this message
+func (im *indexedMessage) Info() *types.MessageInfo {
+	return &types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     im.Chat,
+			Sender:   im.Sender,
+			IsFromMe: im.FromMe,
+			IsGroup:  im.IsGroup,
+		},
+		ID:        im.ID,
+		Timestamp: im.Timestamp,
+	}
+}
+
+// Returns the media type and downloadable sub message of a message, if any
+func getDownloadable(msg *waProto.Message) (string, whatsmeow.DownloadableMessage) {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return "image", msg.GetImageMessage()
+	case msg.GetVideoMessage() != nil:
+		return "video", msg.GetVideoMessage()
+	case msg.GetAudioMessage() != nil:
+		return "audio", msg.GetAudioMessage()
+	case msg.GetDocumentMessage() != nil:
+		return "document", msg.GetDocumentMessage()
+	case msg.GetStickerMessage() != nil:
+		return "sticker", msg.GetStickerMessage()
+	}
+	return "", nil
+}
+
+// Points the media sub message of msg to a new direct path
+func setDirectPath(msg *waProto.Message, directPath string) {
+	switch {
+	case msg.GetImageMessage() != nil:
+		msg.ImageMessage.DirectPath = proto.String(directPath)
+	case msg.GetVideoMessage() != nil:
+		msg.VideoMessage.DirectPath = proto.String(directPath)
+	case msg.GetAudioMessage() != nil:
+		msg.AudioMessage.DirectPath = proto.String(directPath)
+	case msg.GetDocumentMessage() != nil:
+		msg.DocumentMessage.DirectPath = proto.String(directPath)
+	case msg.GetStickerMessage() != nil:
+		msg.StickerMessage.DirectPath = proto.String(directPath)
+	}
+}
+
+// Returns the content of a message wrapped in view once, ephemeral or
+// document with caption containers, as incoming messages are indexed
+func unwrapMessage(msg *waProto.Message) *waProto.Message {
+	for {
+		switch {
+		case msg.GetEphemeralMessage().GetMessage() != nil:
+			msg = msg.GetEphemeralMessage().GetMessage()
+		case msg.GetViewOnceMessage().GetMessage() != nil:
+			msg = msg.GetViewOnceMessage().GetMessage()
+		case msg.GetViewOnceMessageV2().GetMessage() != nil:
+			msg = msg.GetViewOnceMessageV2().GetMessage()
+		case msg.GetViewOnceMessageV2Extension().GetMessage() != nil:
+			msg = msg.GetViewOnceMessageV2Extension().GetMessage()
+		case msg.GetDocumentWithCaptionMessage().GetMessage() != nil:
+			msg = msg.GetDocumentWithCaptionMessage().GetMessage()
+		default:
+			return msg
+		}
+	}
+}
+
+// Returns a copy of msg without its content: text, captions, link previews,
+// thumbnails, contact cards and locations. What replies, edits, reactions,
+// poll votes and media downloads need is kept: the message type, the media
+// descriptors and the poll options.
+func withoutContent(msg *waProto.Message) *waProto.Message {
+	msg = proto.Clone(msg).(*waProto.Message)
+	setMessageText(msg, "")
+	if m := msg.ExtendedTextMessage; m != nil {
+		m.MatchedText, m.CanonicalUrl, m.Description, m.Title, m.JpegThumbnail = nil, nil, nil, nil, nil
+	}
+	if m := msg.ImageMessage; m != nil {
+		m.JpegThumbnail = nil
+	}
+	if m := msg.VideoMessage; m != nil {
+		m.JpegThumbnail = nil
+	}
+	if m := msg.DocumentMessage; m != nil {
+		m.JpegThumbnail = nil
+	}
+	if m := msg.ContactMessage; m != nil {
+		m.Vcard = nil
+	}
+	for _, m := range msg.GetContactsArrayMessage().GetContacts() {
+		m.Vcard = nil
+	}
+	if m := msg.LocationMessage; m != nil {
+		msg.LocationMessage = &waProto.LocationMessage{ContextInfo: m.ContextInfo}
+	}
+	if m := msg.LiveLocationMessage; m != nil {
+		msg.LiveLocationMessage = &waProto.LiveLocationMessage{ContextInfo: m.ContextInfo}
+	}
+	return msg
+}
+
+// Reports whether the content of an indexed message was left out by
+// withoutContent, so it can not be sent again
+func contentRemoved(msg *waProto.Message) bool {
+	switch {
+	case msg.Conversation != nil, msg.ExtendedTextMessage != nil:
+		return messageText(msg) == ""
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.Vcard == nil
+	case msg.ContactsArrayMessage != nil:
+		for _, contact := range msg.ContactsArrayMessage.GetContacts() {
+			if contact.Vcard == nil {
+				return true
+			}
+		}
+	case msg.LocationMessage != nil:
+		return msg.LocationMessage.DegreesLatitude == nil
+	case msg.LiveLocationMessage != nil:
+		return msg.LiveLocationMessage.DegreesLatitude == nil
+	}
+	return false
+}
+
+// Stores or replaces a message in the local message index. The index is only
+// meant to refer to messages: the full message is kept when stored, that is
+// when the message store is enabled, the message without its content
+// otherwise.
+func indexMessage(db *sql.DB, userID int, info *types.MessageInfo, msg *waProto.Message, stored bool) error {
+	if time.Since(info.Timestamp) > messageIndexRetention {
+		return nil
+	}
+	if !stored {
+		msg = withoutContent(msg)
+	}
+	pruneMessageIndex(db, userID)
+
+	mediaType, _ := getDownloadable(msg)
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO message_index (user_id, chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, chat_jid, message_id) DO UPDATE SET media_type=excluded.media_type, message=excluded.message`
+	case "postgresql":
+		sqlStmt = `INSERT INTO message_index (user_id, chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (user_id, chat_jid, message_id) DO UPDATE SET media_type=excluded.media_type, message=excluded.message`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	_, err = db.Exec(sqlStmt, userID, info.Chat.String(), info.ID, info.Sender.String(), info.IsFromMe, info.IsGroup,
+		mediaType, info.Timestamp.Unix(), data)
+	return err
+}
+
+// When the index of each user was last pruned
+var messageIndexPruned sync.Map
+
+// Removes the index entries of a user past messageIndexRetention, at most
+// once an hour
+func pruneMessageIndex(db *sql.DB, userID int) {
+	now := time.Now()
+	if last, ok := messageIndexPruned.Load(userID); ok && now.Sub(last.(time.Time)) < time.Hour {
+		return
+	}
+	messageIndexPruned.Store(userID, now)
+
+	before := now.Add(-messageIndexRetention).Unix()
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`DELETE FROM message_index WHERE user_id = ? AND timestamp < ?`, userID, before)
+	case "postgresql":
+		_, err = db.Exec(`DELETE FROM message_index WHERE user_id = $1 AND timestamp < $2`, userID, before)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userID).Msg("Failed to prune message index")
+	}
+}
+
+// Looks up a message in the local message index. Chat may be empty, in which
+// case the most recent message with that ID is returned.
+func getIndexedMessage(db *sql.DB, userID int, chat string, id string) (*indexedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		if chat == "" {
+			row = db.QueryRow(`SELECT chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message FROM message_index
+				WHERE user_id = ? AND message_id = ? ORDER BY timestamp DESC LIMIT 1`, userID, id)
+		} else {
+			row = db.QueryRow(`SELECT chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message FROM message_index
+				WHERE user_id = ? AND chat_jid = ? AND message_id = ? LIMIT 1`, userID, chat, id)
+		}
+	case "postgresql":
+		if chat == "" {
+			row = db.QueryRow(`SELECT chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message FROM message_index
+				WHERE user_id = $1 AND message_id = $2 ORDER BY timestamp DESC LIMIT 1`, userID, id)
+		} else {
+			row = db.QueryRow(`SELECT chat_jid, message_id, sender_jid, from_me, is_group, media_type, timestamp, message FROM message_index
+				WHERE user_id = $1 AND chat_jid = $2 AND message_id = $3 LIMIT 1`, userID, chat, id)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	var im indexedMessage
+	var chatJID, senderJID string
+	var timestamp int64
+	var data []byte
+	err := row.Scan(&chatJID, &im.ID, &senderJID, &im.FromMe, &im.IsGroup, &im.MediaType, &timestamp, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errMessageNotIndexed
+	} else if err != nil {
+		return nil, err
+	}
+
+	im.Chat, _ = types.ParseJID(chatJID)
+	im.Sender, _ = types.ParseJID(senderJID)
+	im.Timestamp = time.Unix(timestamp, 0)
+	im.Message = &waProto.Message{}
+	if err := proto.Unmarshal(data, im.Message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal indexed message: %w", err)
+	}
+	return &im, nil
+}
+
+// Returns the oldest indexed message of a chat, the natural starting point
+// to ask for older history
+func getOldestIndexedMessage(db *sql.DB, userID int, chat types.JID) (*indexedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT message_id FROM message_index WHERE user_id = ? AND chat_jid = ?
+			ORDER BY timestamp, message_id LIMIT 1`, userID, chat.String())
+	case "postgresql":
+		row = db.QueryRow(`SELECT message_id FROM message_index WHERE user_id = $1 AND chat_jid = $2
+			ORDER BY timestamp, message_id LIMIT 1`, userID, chat.String())
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var id string
+	if err := row.Scan(&id); errors.Is(err, sql.ErrNoRows) {
+		return nil, errMessageNotIndexed
+	} else if err != nil {
+		return nil, err
+	}
+	return getIndexedMessage(db, userID, chat.String(), id)
+}
+
+// Returns the most recent indexed message of a chat
+func getLatestIndexedMessage(db *sql.DB, userID int, chat types.JID) (*indexedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT message_id FROM message_index WHERE user_id = ? AND chat_jid = ?
+			ORDER BY timestamp DESC, message_id DESC LIMIT 1`, userID, chat.String())
+	case "postgresql":
+		row = db.QueryRow(`SELECT message_id FROM message_index WHERE user_id = $1 AND chat_jid = $2
+			ORDER BY timestamp DESC, message_id DESC LIMIT 1`, userID, chat.String())
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var id string
+	if err := row.Scan(&id); errors.Is(err, sql.ErrNoRows) {
+		return nil, errMessageNotIndexed
+	} else if err != nil {
+		return nil, err
+	}
+	return getIndexedMessage(db, userID, chat.String(), id)
+}
+
+// Pending media re-upload requests, keyed by user and message ID. Several
+// requests can wait for the same message.
+var mediaRetryWaiters = struct {
+	sync.Mutex
+	m map[string][]chan *events.MediaRetry
+}{m: make(map[string][]chan *events.MediaRetry)}
+
+func mediaRetryKey(userID int, messageID string) string {
+	return fmt.Sprintf("%d:%s", userID, messageID)
+}
+
+// Registers a request waiting for the re-upload of a message. The returned
+// function removes it again.
+func addMediaRetryWaiter(key string) (chan *events.MediaRetry, func()) {
+	ch := make(chan *events.MediaRetry, 1)
+	mediaRetryWaiters.Lock()
+	mediaRetryWaiters.m[key] = append(mediaRetryWaiters.m[key], ch)
+	mediaRetryWaiters.Unlock()
+	return ch, func() {
+		mediaRetryWaiters.Lock()
+		defer mediaRetryWaiters.Unlock()
+		waiters := mediaRetryWaiters.m[key]
+		for i, waiter := range waiters {
+			if waiter == ch {
+				waiters = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(mediaRetryWaiters.m, key)
+		} else {
+			mediaRetryWaiters.m[key] = waiters
+		}
+	}
+}
+
+// Hands a media retry notification to the requests waiting for it, if any
+func deliverMediaRetry(userID int, evt *events.MediaRetry) bool {
+	mediaRetryWaiters.Lock()
+	defer mediaRetryWaiters.Unlock()
+	waiters := mediaRetryWaiters.m[mediaRetryKey(userID, evt.MessageID)]
+	for _, ch := range waiters {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+	return len(waiters) > 0
+}
+
+// Downloads the media of an indexed message, asking the sender's phone to
+// upload it again when the copy on the WhatsApp CDN has expired
+func downloadIndexedMedia(client *whatsmeow.Client, db *sql.DB, userID int, im *indexedMessage) ([]byte, error) {
+	var data []byte
+	err := fetchIndexedMedia(client, db, userID, im, func(msg whatsmeow.DownloadableMessage) (err error) {
+		data, err = client.Download(msg)
+		return err
+	})
+	return data, err
+}
+
+// Runs download for the media of an indexed message, and once more after a
+// re-upload when the copy on the WhatsApp CDN has expired
+func fetchIndexedMedia(client *whatsmeow.Client, db *sql.DB, userID int, im *indexedMessage, download func(whatsmeow.DownloadableMessage) error) error {
+	_, downloadable := getDownloadable(im.Message)
+	if downloadable == nil {
+		return errors.New("message has no media")
+	}
+
+	err := download(downloadable)
+	if !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) && !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		return err
+	}
+
+	log.Info().Str("id", im.ID).Str("chat", im.Chat.String()).Msg("Media expired on server, requesting re-upload")
+
+	ch, removeWaiter := addMediaRetryWaiter(mediaRetryKey(userID, im.ID))
+	defer removeWaiter()
+
+	mediaKey := downloadable.GetMediaKey()
+	if err := client.SendMediaRetryReceipt(im.Info(), mediaKey); err != nil {
+		return fmt.Errorf("failed to request media re-upload: %w", err)
+	}
+
+	var evt *events.MediaRetry
+	select {
+	case evt = <-ch:
+	case <-time.After(mediaRetryTimeout):
+		return errors.New("timed out waiting for media re-upload")
+	}
+
+	retryData, err := whatsmeow.DecryptMediaRetryNotification(evt, mediaKey)
+	if err != nil {
+		return fmt.Errorf("media re-upload failed: %w", err)
+	}
+	if retryData.GetResult() != waProto.MediaRetryNotification_SUCCESS {
+		return fmt.Errorf("media re-upload failed: %s", retryData.GetResult())
+	}
+
+	setDirectPath(im.Message, retryData.GetDirectPath())
+	if err := indexMessage(db, userID, im.Info(), im.Message, messageStoreEnabled(db, userID)); err != nil {
+		log.Warn().Err(err).Str("id", im.ID).Msg("Failed to update message index with new media path")
+	}
+
+	_, downloadable = getDownloadable(im.Message)
+	return download(downloadable)
+}
+
+// Returns the text or caption of a message
+func messageText(msg *waProto.Message) string {
+	switch {
+	case msg.Conversation != nil:
+		return msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.GetText()
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.GetCaption()
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.GetCaption()
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.GetCaption()
+	}
+	return ""
+}
+
+// Replaces the text or caption of a message. Returns false if the message
+// type has no text.
+func setMessageText(msg *waProto.Message, text string) bool {
+	switch {
+	case msg.Conversation != nil:
+		msg.Conversation = proto.String(text)
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.Text = proto.String(text)
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.Caption = proto.String(text)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.Caption = proto.String(text)
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.Caption = proto.String(text)
+	default:
+		return false
+	}
+	return true
+}
+
+// Applies an edit to the indexed copy of the original message. Returns the
+// original as it was before the edit, or errMessageNotIndexed.
+func indexEdit(db *sql.DB, userID int, chat types.JID, edit *waProto.ProtocolMessage, stored bool) (*indexedMessage, error) {
+	original, err := getIndexedMessage(db, userID, chat.String(), edit.GetKey().GetId())
+	if err != nil {
+		return nil, err
+	}
+	edited := proto.Clone(original.Message).(*waProto.Message)
+	if !setMessageText(edited, messageText(edit.GetEditedMessage())) {
+		return original, nil
+	}
+	return original, indexMessage(db, userID, original.Info(), edited, stored)
+}
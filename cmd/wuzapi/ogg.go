@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Number of bars in the waveform shown for voice notes
+const waveformSamples = 64
+
+// Opus granule positions are always expressed at 48kHz
+const opusSampleRate = 48000
+
+// Properties of an Ogg/Opus stream needed to send it as a voice note
+type opusMeta struct {
+	Seconds  uint32
+	Waveform []byte
+}
+
+// Parses an Ogg container, checks that it carries Opus audio and computes the
+// duration and a waveform. Opus is not decoded: the waveform is estimated from
+// the size of the audio packets, which follows loudness closely with VBR.
+func getOpusMeta(data []byte) (*opusMeta, error) {
+	if !bytes.HasPrefix(data, []byte("OggS")) {
+		return nil, errors.New("audio is not an Ogg file")
+	}
+
+	var packets []int
+	var packet []byte
+	var granule int64
+	var preSkip uint16
+	first := true
+
+	for len(data) > 0 {
+		if len(data) < 27 || !bytes.HasPrefix(data, []byte("OggS")) {
+			return nil, errors.New("corrupt Ogg page")
+		}
+		pageGranule := int64(binary.LittleEndian.Uint64(data[6:14]))
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			return nil, errors.New("corrupt Ogg page")
+		}
+		lacing := data[27 : 27+segments]
+		body := data[27+segments:]
+
+		for _, size := range lacing {
+			if int(size) > len(body) {
+				return nil, errors.New("truncated Ogg page")
+			}
+			packet = append(packet, body[:size]...)
+			body = body[size:]
+			if size == 255 {
+				continue
+			}
+			if first {
+				codec, err := oggCodec(packet)
+				if err != nil {
+					return nil, err
+				}
+				if codec != "opus" {
+					return nil, fmt.Errorf("unsupported audio codec %s, voice notes must be Ogg/Opus", codec)
+				}
+				preSkip = binary.LittleEndian.Uint16(packet[10:12])
+				first = false
+			} else if !bytes.HasPrefix(packet, []byte("OpusTags")) {
+				packets = append(packets, len(packet))
+			}
+			packet = packet[:0]
+		}
+
+		if pageGranule > 0 {
+			granule = pageGranule
+		}
+		data = body
+	}
+
+	if first {
+		return nil, errors.New("audio has no Ogg stream")
+	}
+
+	meta := &opusMeta{Waveform: makeWaveform(packets)}
+	if samples := granule - int64(preSkip); samples > 0 {
+		meta.Seconds = uint32(math.Round(float64(samples) / opusSampleRate))
+	}
+	return meta, nil
+}
+
+// Identifies the codec of an Ogg stream from its first packet
+func oggCodec(packet []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		if len(packet) < 19 {
+			return "", errors.New("corrupt Opus header")
+		}
+		return "opus", nil
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		return "vorbis", nil
+	case bytes.HasPrefix(packet, []byte("Speex   ")):
+		return "speex", nil
+	case bytes.HasPrefix(packet, []byte("\x7fFLAC")):
+		return "flac", nil
+	}
+	return "unknown", nil
+}
+
+// Reduces packet sizes to a waveform of values between 0 and 100
+func makeWaveform(packets []int) []byte {
+	waveform := make([]byte, waveformSamples)
+	if len(packets) == 0 {
+		return waveform
+	}
+
+	levels := make([]float64, waveformSamples)
+	peak := 0.0
+	for i := range levels {
+		from := i * len(packets) / waveformSamples
+		to := (i + 1) * len(packets) / waveformSamples
+		if to <= from {
+			to = from + 1
+		}
+		if to > len(packets) {
+			to = len(packets)
+			from = to - 1
+		}
+		sum := 0
+		for _, size := range packets[from:to] {
+			sum += size
+		}
+		levels[i] = float64(sum) / float64(to-from)
+		peak = math.Max(peak, levels[i])
+	}
+
+	// Silence in Opus still takes a few bytes per packet, use the quietest
+	// bucket as the floor so pauses show up as flat bars
+	floor := peak
+	for _, level := range levels {
+		floor = math.Min(floor, level)
+	}
+	if peak-floor < 1 {
+		for i := range waveform {
+			waveform[i] = 50
+		}
+		return waveform
+	}
+	for i, level := range levels {
+		waveform[i] = byte(math.Round((level - floor) / (peak - floor) * 100))
+	}
+	return waveform
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Builds an Ogg page holding packets. A nil packet ends the page with an
+// unfinished 255 byte segment, continued on the next page.
+func oggPage(granule int64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, packet := range packets {
+		if packet == nil {
+			lacing = append(lacing, 255)
+			body = append(body, bytes.Repeat([]byte{0xaa}, 255)...)
+			continue
+		}
+		size := len(packet)
+		for ; size >= 255; size -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(size))
+		body = append(body, packet...)
+	}
+
+	page := []byte("OggS\x00\x00")
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = append(page, make([]byte, 12)...)
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+func opusHead(preSkip uint16) []byte {
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, preSkip)
+	return append(head, 0x80, 0xbb, 0, 0, 0, 0, 0)
+}
+
+func audioPackets(sizes ...int) [][]byte {
+	packets := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		packets[i] = bytes.Repeat([]byte{0x55}, size)
+	}
+	return packets
+}
+
+func TestGetOpusMeta(t *testing.T) {
+	tags := []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantSeconds uint32
+		wantErr     string
+	}{
+		{
+			name: "voice note",
+			data: bytes.Join([][]byte{
+				oggPage(0, opusHead(312)),
+				oggPage(0, tags),
+				oggPage(48000*2, audioPackets(40, 60, 80)...),
+				oggPage(48000*3+312, audioPackets(30, 20)...),
+			}, nil),
+			wantSeconds: 3,
+		},
+		{
+			name: "duration is rounded",
+			data: bytes.Join([][]byte{
+				oggPage(0, opusHead(0)),
+				oggPage(48000*5/2, audioPackets(10)...),
+			}, nil),
+			wantSeconds: 3,
+		},
+		{
+			name: "packets larger than a segment",
+			data: bytes.Join([][]byte{
+				oggPage(0, opusHead(0), tags),
+				oggPage(48000, audioPackets(255, 300, 510)...),
+			}, nil),
+			wantSeconds: 1,
+		},
+		{
+			name: "packet continued on next page",
+			data: bytes.Join([][]byte{
+				oggPage(0, opusHead(0)),
+				oggPage(-1, nil),
+				oggPage(48000*4, audioPackets(20)...),
+			}, nil),
+			wantSeconds: 4,
+		},
+		{
+			name: "pre-skip longer than stream",
+			data: bytes.Join([][]byte{
+				oggPage(0, opusHead(3840)),
+				oggPage(960, audioPackets(10)...),
+			}, nil),
+			wantSeconds: 0,
+		},
+		{
+			name:    "vorbis",
+			data:    oggPage(0, []byte("\x01vorbis\x00\x00\x00\x00")),
+			wantErr: "unsupported audio codec vorbis",
+		},
+		{
+			name:    "not an Ogg file",
+			data:    []byte("ID3\x03\x00\x00\x00"),
+			wantErr: "not an Ogg file",
+		},
+		{
+			name:    "garbage after first page",
+			data:    append(oggPage(0, opusHead(0)), "junk data"...),
+			wantErr: "corrupt Ogg page",
+		},
+		{
+			name:    "truncated page",
+			data:    oggPage(0, opusHead(0))[:40],
+			wantErr: "truncated Ogg page",
+		},
+		{
+			name:    "short Opus header",
+			data:    oggPage(0, []byte("OpusHead\x01")),
+			wantErr: "corrupt Opus header",
+		},
+		{
+			name:    "no packets",
+			data:    oggPage(0),
+			wantErr: "no Ogg stream",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := getOpusMeta(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("getOpusMeta() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getOpusMeta() error = %v", err)
+			}
+			if meta.Seconds != tt.wantSeconds {
+				t.Errorf("getOpusMeta() seconds = %d, want %d", meta.Seconds, tt.wantSeconds)
+			}
+			if len(meta.Waveform) != waveformSamples {
+				t.Errorf("getOpusMeta() waveform has %d samples, want %d", len(meta.Waveform), waveformSamples)
+			}
+		})
+	}
+}
+
+func TestMakeWaveform(t *testing.T) {
+	ramp := make([]int, 128)
+	for i := range ramp {
+		ramp[i] = 10 + i
+	}
+
+	tests := []struct {
+		name    string
+		packets []int
+		check   func(waveform []byte) bool
+	}{
+		{
+			name:    "no packets",
+			packets: nil,
+			check:   func(w []byte) bool { return bytes.Equal(w, make([]byte, waveformSamples)) },
+		},
+		{
+			name:    "constant level",
+			packets: []int{40, 40, 40, 40},
+			check:   func(w []byte) bool { return bytes.Equal(w, bytes.Repeat([]byte{50}, waveformSamples)) },
+		},
+		{
+			name:    "rising level",
+			packets: ramp,
+			check: func(w []byte) bool {
+				for i := 1; i < len(w); i++ {
+					if w[i] < w[i-1] {
+						return false
+					}
+				}
+				return w[0] == 0 && w[len(w)-1] == 100
+			},
+		},
+		{
+			name:    "fewer packets than samples",
+			packets: []int{10, 100, 10},
+			check: func(w []byte) bool {
+				return w[0] == 0 && w[waveformSamples/2] == 100 && w[waveformSamples-1] == 0
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waveform := makeWaveform(tt.packets)
+			if len(waveform) != waveformSamples || !tt.check(waveform) {
+				t.Errorf("makeWaveform() = %v", waveform)
+			}
+		})
+	}
+}
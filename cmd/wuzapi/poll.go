@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Maximum number of options WhatsApp allows in a poll
+const maxPollOptions = 12
+
+// Latest selection of a voter in a poll
+type pollVote struct {
+	Voter     string
+	Options   []string
+	Timestamp time.Time
+}
+
+// Returns the poll of a poll creation message, whatever its version
+func getPollCreation(msg *waProto.Message) *waProto.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// Maps the option hashes of a decrypted vote back to the option names
+func pollOptionNames(poll *waProto.PollCreationMessage, hashes [][]byte) []string {
+	names := make([]string, 0, len(hashes))
+	for _, option := range poll.GetOptions() {
+		hash := sha256.Sum256([]byte(option.GetOptionName()))
+		for _, selected := range hashes {
+			if bytes.Equal(hash[:], selected) {
+				names = append(names, option.GetOptionName())
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Records the current selection of a voter, replacing any previous vote.
+// An empty selection means the vote was withdrawn.
+func savePollVote(db *sql.DB, userID int, chat types.JID, pollID string, voter types.JID, options []string, timestamp time.Time) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO poll_votes (user_id, chat_jid, poll_id, voter_jid, options, timestamp)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, chat_jid, poll_id, voter_jid) DO UPDATE SET options=excluded.options, timestamp=excluded.timestamp
+			WHERE excluded.timestamp >= poll_votes.timestamp`
+	case "postgresql":
+		sqlStmt = `INSERT INTO poll_votes (user_id, chat_jid, poll_id, voter_jid, options, timestamp)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id, chat_jid, poll_id, voter_jid) DO UPDATE SET options=excluded.options, timestamp=excluded.timestamp
+			WHERE excluded.timestamp >= poll_votes.timestamp`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	_, err = db.Exec(sqlStmt, userID, chat.String(), pollID, voter.ToNonAD().String(), string(data), timestamp.Unix())
+	return err
+}
+
+// Returns the latest vote of every voter in a poll
+func getPollVotes(db *sql.DB, userID int, chat types.JID, pollID string) ([]pollVote, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT voter_jid, options, timestamp FROM poll_votes
+			WHERE user_id = ? AND chat_jid = ? AND poll_id = ? ORDER BY timestamp`, userID, chat.String(), pollID)
+	case "postgresql":
+		rows, err = db.Query(`SELECT voter_jid, options, timestamp FROM poll_votes
+			WHERE user_id = $1 AND chat_jid = $2 AND poll_id = $3 ORDER BY timestamp`, userID, chat.String(), pollID)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var votes []pollVote
+	for rows.Next() {
+		var vote pollVote
+		var options string
+		var timestamp int64
+		if err := rows.Scan(&vote.Voter, &options, &timestamp); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(options), &vote.Options); err != nil {
+			return nil, fmt.Errorf("invalid options stored for vote: %w", err)
+		}
+		vote.Timestamp = time.Unix(timestamp, 0)
+		votes = append(votes, vote)
+	}
+	return votes, rows.Err()
+}
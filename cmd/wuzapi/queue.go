@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// States of a queued message
+const (
+	queuePending   = "pending"
+	queueSending   = "sending"
+	queueSent      = "sent"
+	queueFailed    = "failed"
+	queueCancelled = "cancelled"
+)
+
+// Pacing defaults and limits of the send queue
+const (
+	defaultQueuePerMinute     = 20
+	maxQueuePerMinute         = 120
+	defaultQueueJitterSeconds = 5
+	maxQueueJitterSeconds     = 300
+	queuePollInterval         = time.Second
+	minTypingTime             = time.Second
+	maxTypingTime             = 8 * time.Second
+	typingTimePerChar         = 50 * time.Millisecond
+	defaultQueueListLimit     = 100
+)
+
+var (
+	errQueuedMessageNotFound = errors.New("queued message not found")
+	errQueuedMessageNotDue   = errors.New("queued message is no longer pending")
+)
+
+// How a user's sends are queued. When Enabled, messages to /chat/send are
+// sent in order by a background worker, at most PerMinute per minute plus
+// a random delay of up to JitterSeconds, and at most DailyCap a day when it
+// is not zero. With Typing the worker shows the user typing before sending.
+type queueSettings struct {
+	Enabled       bool
+	PerMinute     int
+	JitterSeconds int
+	Typing        bool
+	DailyCap      int
+}
+
+var defaultQueueSettings = queueSettings{
+	PerMinute:     defaultQueuePerMinute,
+	JitterSeconds: defaultQueueJitterSeconds,
+	Typing:        true,
+}
+
+func (q *queueSettings) validate() error {
+	if q.PerMinute < 1 || q.PerMinute > maxQueuePerMinute {
+		return fmt.Errorf("PerMinute must be between 1 and %d", maxQueuePerMinute)
+	}
+	if q.JitterSeconds < 0 || q.JitterSeconds > maxQueueJitterSeconds {
+		return fmt.Errorf("JitterSeconds must be between 0 and %d", maxQueueJitterSeconds)
+	}
+	if q.DailyCap < 0 {
+		return errors.New("DailyCap can not be negative")
+	}
+	return nil
+}
+
+// Time to wait between two queued sends
+func (q *queueSettings) delay() time.Duration {
+	delay := time.Minute / time.Duration(q.PerMinute)
+	if q.JitterSeconds > 0 {
+		delay += time.Duration(rand.Int63n(int64(q.JitterSeconds) * int64(time.Second)))
+	}
+	return delay
+}
+
+// Message waiting in or sent through the send queue
+type queuedMessage struct {
+	Id        string
+	Chat      string
+	Type      string
+	Status    string
+	Error     string `json:",omitempty"`
+	CreatedAt time.Time
+	SentAt    *time.Time `json:",omitempty"`
+
+	message *waProto.Message
+}
+
+// Final result of a queued message, posted as a SendResult webhook
+type sendResultEvent struct {
+	Id        string
+	Chat      types.JID
+	Status    string
+	Timestamp time.Time
+	Error     string
+}
+
+func getQueueSettings(db *sql.DB, userID int) (queueSettings, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT enabled, per_minute, jitter_seconds, typing, daily_cap FROM queue_settings WHERE user_id = ?`, userID)
+	case "postgresql":
+		row = db.QueryRow(`SELECT enabled, per_minute, jitter_seconds, typing, daily_cap FROM queue_settings WHERE user_id = $1`, userID)
+	default:
+		return defaultQueueSettings, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var q queueSettings
+	err := row.Scan(&q.Enabled, &q.PerMinute, &q.JitterSeconds, &q.Typing, &q.DailyCap)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultQueueSettings, nil
+	} else if err != nil {
+		return defaultQueueSettings, err
+	}
+	return q, nil
+}
+
+func saveQueueSettings(db *sql.DB, userID int, q queueSettings) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO queue_settings (user_id, enabled, per_minute, jitter_seconds, typing, daily_cap) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled, per_minute = excluded.per_minute,
+				jitter_seconds = excluded.jitter_seconds, typing = excluded.typing, daily_cap = excluded.daily_cap`
+	case "postgresql":
+		sqlStmt = `INSERT INTO queue_settings (user_id, enabled, per_minute, jitter_seconds, typing, daily_cap) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled, per_minute = excluded.per_minute,
+				jitter_seconds = excluded.jitter_seconds, typing = excluded.typing, daily_cap = excluded.daily_cap`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, q.Enabled, q.PerMinute, q.JitterSeconds, q.Typing, q.DailyCap)
+	return err
+}
+
+// What became of a message given to sendOrQueue
+type sendOutcome struct {
+	Resp      whatsmeow.SendResponse
+	Queued    bool
+	Scheduled *scheduledMessage
+}
+
+// Sends a message right away, or adds it to the send queue when the user
+// has queued mode enabled. Messages of requests that carry a schedule are
+// stored to be sent later instead.
+func (s *server) sendOrQueue(ctx context.Context, userid int, recipient types.JID, msg *waProto.Message, msgid string) (sendOutcome, error) {
+	if schedule := scheduleFromContext(ctx); schedule != nil {
+		media, err := scheduledMediaCopy(clientPointer[userid], msg)
+		if err != nil {
+			return sendOutcome{}, fmt.Errorf("failed to keep media for scheduled message: %w", err)
+		}
+		sm, err := scheduleMessage(s.db, userid, recipient, msg, msgid, schedule, media)
+		if err != nil {
+			return sendOutcome{}, fmt.Errorf("failed to schedule message: %w", err)
+		}
+		return sendOutcome{Scheduled: sm}, nil
+	}
+
+	settings, err := getQueueSettings(s.db, userid)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get queue settings, sending right away")
+	}
+	if !settings.Enabled {
+		resp, err := s.sendMessage(context.Background(), userid, recipient, msg, msgid)
+		return sendOutcome{Resp: resp}, err
+	}
+	if err := enqueueMessage(s.db, userid, recipient, msg, msgid); err != nil {
+		return sendOutcome{}, fmt.Errorf("failed to queue message: %w", err)
+	}
+	return sendOutcome{Queued: true}, nil
+}
+
+// Response of the send endpoints
+func (o sendOutcome) response(msgid string) map[string]interface{} {
+	if o.Scheduled != nil {
+		log.Info().Str("id", msgid).Msg("Message scheduled")
+		return map[string]interface{}{"Details": "Scheduled", "Id": msgid, "NextRun": o.Scheduled.NextRun}
+	}
+	if o.Queued {
+		log.Info().Str("id", msgid).Msg("Message queued")
+		return map[string]interface{}{"Details": "Queued", "Id": msgid}
+	}
+	log.Info().Str("timestamp", fmt.Sprintf("%d", o.Resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+	return map[string]interface{}{"Details": "Sent", "Timestamp": o.Resp.Timestamp, "Id": msgid}
+}
+
+func enqueueMessage(db *sql.DB, userID int, chat types.JID, msg *waProto.Message, id string) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO send_queue (user_id, message_id, chat_jid, type, message, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	case "postgresql":
+		sqlStmt = `INSERT INTO send_queue (user_id, message_id, chat_jid, type, message, status, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err = db.Exec(sqlStmt, userID, id, chat.String(), messageType(unwrapMessage(msg)), data, queuePending, time.Now().UnixMilli())
+	return err
+}
+
+// Cancels a message that is still waiting in the queue
+func cancelQueuedMessage(db *sql.DB, userID int, id string) error {
+	if _, err := getQueuedMessage(db, userID, id); err != nil {
+		return err
+	}
+	return setQueuedMessageStatus(db, userID, id, queuePending, queueCancelled, "", time.Time{})
+}
+
+func scanQueuedMessage(scan func(dest ...interface{}) error) (*queuedMessage, error) {
+	var qm queuedMessage
+	var data []byte
+	var createdAt, sentAt int64
+	if err := scan(&qm.Id, &qm.Chat, &qm.Type, &data, &qm.Status, &qm.Error, &createdAt, &sentAt); err != nil {
+		return nil, err
+	}
+	qm.CreatedAt = time.UnixMilli(createdAt)
+	qm.SentAt = optUnixMilli(sentAt)
+	qm.message = &waProto.Message{}
+	if err := proto.Unmarshal(data, qm.message); err != nil {
+		return nil, fmt.Errorf("failed to decode queued message %s: %w", qm.Id, err)
+	}
+	return &qm, nil
+}
+
+// Returns the oldest pending message of a user, nil if there is none
+func nextQueuedMessage(db *sql.DB, userID int) (*queuedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = ? AND status = ? ORDER BY created_at, message_id LIMIT 1`, userID, queuePending)
+	case "postgresql":
+		row = db.QueryRow(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = $1 AND status = $2 ORDER BY created_at, message_id LIMIT 1`, userID, queuePending)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	qm, err := scanQueuedMessage(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return qm, err
+}
+
+func getQueuedMessage(db *sql.DB, userID int, id string) (*queuedMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = ? AND message_id = ?`, userID, id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = $1 AND message_id = $2`, userID, id)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	qm, err := scanQueuedMessage(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errQueuedMessageNotFound
+	}
+	return qm, err
+}
+
+// Returns the messages of a user still waiting in the queue, oldest first
+func listQueuedMessages(db *sql.DB, userID int, limit int) ([]queuedMessage, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = ? AND status IN (?, ?) ORDER BY created_at, message_id LIMIT ?`, userID, queuePending, queueSending, limit)
+	case "postgresql":
+		rows, err = db.Query(`SELECT message_id, chat_jid, type, message, status, error, created_at, sent_at FROM send_queue
+			WHERE user_id = $1 AND status IN ($2, $3) ORDER BY created_at, message_id LIMIT $4`, userID, queuePending, queueSending, limit)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []queuedMessage{}
+	for rows.Next() {
+		qm, err := scanQueuedMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *qm)
+	}
+	return messages, rows.Err()
+}
+
+// Counts the pending messages of a user and those sent since a given time
+func countQueuedMessages(db *sql.DB, userID int, since time.Time) (pending int, sent int, err error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0),
+				COALESCE(SUM(CASE WHEN status = ? AND sent_at >= ? THEN 1 ELSE 0 END), 0)
+			FROM send_queue WHERE user_id = ?`, queuePending, queueSent, since.UnixMilli(), userID)
+	case "postgresql":
+		row = db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN status = $1 THEN 1 ELSE 0 END), 0),
+				COALESCE(SUM(CASE WHEN status = $2 AND sent_at >= $3 THEN 1 ELSE 0 END), 0)
+			FROM send_queue WHERE user_id = $4`, queuePending, queueSent, since.UnixMilli(), userID)
+	default:
+		return 0, 0, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	err = row.Scan(&pending, &sent)
+	return pending, sent, err
+}
+
+// Moves a queued message from one state to another. Fails with
+// errQueuedMessageNotDue when the message is not in the expected state.
+func setQueuedMessageStatus(db *sql.DB, userID int, id string, from string, to string, errText string, sentAt time.Time) error {
+	var res sql.Result
+	var err error
+	switch dbType {
+	case "sqlite3":
+		res, err = db.Exec(`UPDATE send_queue SET status = ?, error = ?, sent_at = ? WHERE user_id = ? AND message_id = ? AND status = ?`,
+			to, errText, unixMilliOrZero(sentAt), userID, id, from)
+	case "postgresql":
+		res, err = db.Exec(`UPDATE send_queue SET status = $1, error = $2, sent_at = $3 WHERE user_id = $4 AND message_id = $5 AND status = $6`,
+			to, errText, unixMilliOrZero(sentAt), userID, id, from)
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errQueuedMessageNotDue
+	}
+	return nil
+}
+
+// Returns the time of the last queued send of a user
+func lastQueuedSend(db *sql.DB, userID int) (time.Time, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT COALESCE(MAX(sent_at), 0) FROM send_queue WHERE user_id = ? AND status = ?`, userID, queueSent)
+	case "postgresql":
+		row = db.QueryRow(`SELECT COALESCE(MAX(sent_at), 0) FROM send_queue WHERE user_id = $1 AND status = $2`, userID, queueSent)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var ms int64
+	if err := row.Scan(&ms); err != nil || ms == 0 {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// Fails the messages that were being sent when the worker stopped, as
+// there is no telling whether they reached WhatsApp
+func failInterruptedSends(db *sql.DB, userID int) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE send_queue SET status = ?, error = ? WHERE user_id = ? AND status = ?`,
+			queueFailed, "interrupted while sending", userID, queueSending)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE send_queue SET status = $1, error = $2 WHERE user_id = $3 AND status = $4`,
+			queueFailed, "interrupted while sending", userID, queueSending)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Start of the current day, when daily caps are reset
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// Paces the sends of a session. The send queue and broadcasts both go
+// through it, so they take turns and their delays add up instead of
+// running side by side.
+type sendGate struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// Runs send when the gate is open, keeping the other senders out until it
+// returns. The gate then stays shut until the time send returns.
+func (g *sendGate) run(send func() time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Now().Before(g.next) {
+		return
+	}
+	g.next = send()
+}
+
+// Keeps the gate shut until t
+func (g *sendGate) holdUntil(t time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t.After(g.next) {
+		g.next = t
+	}
+}
+
+// Returns when the daily cap of a user allows sending again, or the zero
+// time when it does now. Queued and broadcast messages count towards it.
+func dailyCapReset(db *sql.DB, userID int, settings queueSettings) (time.Time, error) {
+	if settings.DailyCap <= 0 {
+		return time.Time{}, nil
+	}
+	today := startOfDay(time.Now())
+	_, queued, err := countQueuedMessages(db, userID, today)
+	if err != nil {
+		return time.Time{}, err
+	}
+	broadcast, err := countBroadcastSends(db, userID, today)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if queued+broadcast < settings.DailyCap {
+		return time.Time{}, nil
+	}
+	next := today.AddDate(0, 0, 1)
+	log.Info().Str("userid", fmt.Sprint(userID)).Int("cap", settings.DailyCap).Time("until", next).Msg("Daily send cap reached")
+	return next, nil
+}
+
+// Sends the queued messages of a session, one at a time and paced by the
+// queue settings, until stop is closed. Messages are only sent while the
+// session is connected and logged in.
+func (s *server) runSendQueue(mycli *MyClient, stop <-chan struct{}) {
+	userID := mycli.userID
+	if err := failInterruptedSends(s.db, userID); err != nil {
+		log.Error().Err(err).Msg("Failed to fail interrupted queued sends")
+	}
+
+	if last, err := lastQueuedSend(s.db, userID); err != nil {
+		log.Error().Err(err).Msg("Failed to get last queued send")
+	} else if !last.IsZero() {
+		settings, _ := getQueueSettings(s.db, userID)
+		mycli.sendGate.holdUntil(last.Add(settings.delay()))
+	}
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		client := mycli.WAClient
+		if !client.IsConnected() || client.Store.ID == nil {
+			continue
+		}
+		mycli.sendGate.run(func() time.Time { return s.sendNextQueued(mycli) })
+	}
+}
+
+// Sends the next queued message of a session, if any, and returns when the
+// next send can happen
+func (s *server) sendNextQueued(mycli *MyClient) time.Time {
+	userID := mycli.userID
+	settings, err := getQueueSettings(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get queue settings")
+		return time.Time{}
+	}
+	if reset, err := dailyCapReset(s.db, userID, settings); err != nil {
+		log.Error().Err(err).Msg("Failed to count sends")
+		return time.Time{}
+	} else if !reset.IsZero() {
+		return reset
+	}
+
+	qm, err := nextQueuedMessage(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get next queued message")
+		return time.Time{}
+	}
+	if qm == nil {
+		return time.Time{}
+	}
+	if err := setQueuedMessageStatus(s.db, userID, qm.Id, queuePending, queueSending, "", time.Time{}); err != nil {
+		// Cancelled in the meantime
+		return time.Time{}
+	}
+
+	s.sendQueuedMessage(mycli, qm, settings)
+	return time.Now().Add(settings.delay())
+}
+
+// Sends a message taken from the queue and reports the result
+func (s *server) sendQueuedMessage(mycli *MyClient, qm *queuedMessage, settings queueSettings) {
+	result := sendResultEvent{Id: qm.Id, Status: queueSent}
+
+	chat, err := types.ParseJID(qm.Chat)
+	if err == nil {
+		result.Chat = chat
+		if settings.Typing {
+			simulateTyping(mycli.WAClient, chat, qm.message)
+		}
+		var resp whatsmeow.SendResponse
+		resp, err = s.sendMessage(context.Background(), mycli.userID, chat, qm.message, qm.Id)
+		result.Timestamp = resp.Timestamp
+	}
+	if err != nil {
+		result.Status = queueFailed
+		result.Error = err.Error()
+		result.Timestamp = time.Now()
+		log.Error().Err(err).Str("id", qm.Id).Msg("Failed to send queued message")
+	} else {
+		log.Info().Str("id", qm.Id).Str("chat", qm.Chat).Msg("Queued message sent")
+	}
+
+	if err := setQueuedMessageStatus(s.db, mycli.userID, qm.Id, queueSending, result.Status, result.Error, result.Timestamp); err != nil {
+		log.Error().Err(err).Str("id", qm.Id).Msg("Failed to update queued message")
+	}
+	mycli.myEventHandler(&result)
+}
+
+// Shows the user typing, or recording for voice notes, for a time that
+// grows with the length of the message
+func simulateTyping(client *whatsmeow.Client, chat types.JID, msg *waProto.Message) {
+	media := types.ChatPresenceMediaText
+	if unwrapMessage(msg).GetAudioMessage().GetPtt() {
+		media = types.ChatPresenceMediaAudio
+	}
+	duration := time.Duration(len(messageBody(unwrapMessage(msg)))) * typingTimePerChar
+	if duration < minTypingTime {
+		duration = minTypingTime
+	} else if duration > maxTypingTime {
+		duration = maxTypingTime
+	}
+
+	if err := client.SendChatPresence(chat, types.ChatPresenceComposing, media); err != nil {
+		log.Warn().Err(err).Str("chat", chat.String()).Msg("Failed to send typing presence")
+		return
+	}
+	time.Sleep(duration)
+	if err := client.SendChatPresence(chat, types.ChatPresencePaused, media); err != nil {
+		log.Warn().Err(err).Str("chat", chat.String()).Msg("Failed to send paused presence")
+	}
+}
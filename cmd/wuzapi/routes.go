@@ -41,6 +41,9 @@ func (s *server) routes() {
 	c = c.Append(hlog.RefererHandler("referer"))
 	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
 
+	// Sends can be retried safely with an idempotency key, and scheduled
+	send := c.Append(s.idempotent, s.schedulable)
+
 	s.router.Handle("/session/connect", c.Then(s.Connect())).Methods("POST")
 	s.router.Handle("/session/disconnect", c.Then(s.Disconnect())).Methods("POST")
 	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
@@ -51,18 +54,24 @@ func (s *server) routes() {
 	s.router.Handle("/webhook", c.Then(s.SetWebhook())).Methods("POST")
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
 
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/text", send.Then(s.SendMessage())).Methods("POST")
+	s.router.Handle("/chat/send/image", send.Then(s.SendImage())).Methods("POST")
+	s.router.Handle("/chat/send/audio", send.Then(s.SendAudio())).Methods("POST")
+	s.router.Handle("/chat/send/document", send.Then(s.SendDocument())).Methods("POST")
+	s.router.Handle("/chat/send/video", send.Then(s.SendVideo())).Methods("POST")
+	s.router.Handle("/chat/send/sticker", send.Then(s.SendSticker())).Methods("POST")
+	s.router.Handle("/chat/send/location", send.Then(s.SendLocation())).Methods("POST")
+	s.router.Handle("/chat/send/contact", send.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/poll", send.Then(s.SendPoll())).Methods("POST")
 	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
-	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
+	s.router.Handle("/chat/edit", c.Then(s.EditMessage())).Methods("POST")
+	s.router.Handle("/chat/revoke", c.Then(s.RevokeMessage())).Methods("POST")
+	s.router.Handle("/chat/forward", c.Then(s.ForwardMessage())).Methods("POST")
+	s.router.Handle("/chat/disappearing", c.Then(s.SetDisappearingTimer())).Methods("POST")
+	s.router.Handle("/chat/disappearing/default", c.Then(s.SetDefaultDisappearingTimer())).Methods("POST")
+	s.router.Handle("/chat/send/buttons", send.Then(s.SendButtons())).Methods("POST")
+	s.router.Handle("/chat/send/list", send.Then(s.SendList())).Methods("POST")
+	s.router.Handle("/chat/send/template", send.Then(s.SendTemplate())).Methods("POST")
 
 	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
 	s.router.Handle("/user/check", c.Then(s.CheckUser())).Methods("POST")
@@ -75,6 +84,43 @@ func (s *server) routes() {
 	s.router.Handle("/chat/downloadvideo", c.Then(s.DownloadVideo())).Methods("POST")
 	s.router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
 	s.router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
+	s.router.Handle("/chat/download", c.Then(s.DownloadMessage())).Methods("POST")
+	s.router.Handle("/chat/poll/{id}", c.Then(s.GetPoll())).Methods("GET")
+
+	s.router.Handle("/messagestore", c.Then(s.SetMessageStore())).Methods("POST")
+	s.router.Handle("/messagestore", c.Then(s.GetMessageStore())).Methods("GET")
+	s.router.Handle("/chats", c.Then(s.ListChats())).Methods("GET")
+	s.router.Handle("/chats/{jid}/messages", c.Then(s.GetChatMessages())).Methods("GET")
+	s.router.Handle("/messages/{id}", c.Then(s.GetMessage())).Methods("GET")
+	s.router.Handle("/messages/{id}/status", c.Then(s.GetMessageStatus())).Methods("GET")
+	s.router.Handle("/chats/{jid}/history/backfill", c.Then(s.BackfillHistory())).Methods("POST")
+	s.router.Handle("/history/backfill/{id}", c.Then(s.GetBackfillJob())).Methods("GET")
+
+	s.router.Handle("/queue/settings", c.Then(s.GetQueueSettings())).Methods("GET")
+	s.router.Handle("/queue/settings", c.Then(s.SetQueueSettings())).Methods("POST")
+	s.router.Handle("/queue", c.Then(s.GetQueue())).Methods("GET")
+	s.router.Handle("/queue/{id}", c.Then(s.GetQueuedMessage())).Methods("GET")
+	s.router.Handle("/queue/{id}", c.Then(s.CancelQueuedMessage())).Methods("DELETE")
+
+	s.router.Handle("/scheduled", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/scheduled/{id}", c.Then(s.GetScheduledMessage())).Methods("GET")
+	s.router.Handle("/scheduled/{id}", c.Then(s.UpdateScheduledMessage())).Methods("POST")
+	s.router.Handle("/scheduled/{id}", c.Then(s.CancelScheduledMessage())).Methods("DELETE")
+
+	s.router.Handle("/broadcasts", c.Then(s.CreateBroadcast())).Methods("POST")
+	s.router.Handle("/broadcasts", c.Then(s.ListBroadcasts())).Methods("GET")
+	s.router.Handle("/broadcasts/{id}", c.Then(s.GetBroadcast())).Methods("GET")
+	s.router.Handle("/broadcasts/{id}", c.Then(s.CancelBroadcast())).Methods("DELETE")
+	s.router.Handle("/broadcasts/{id}/recipients", c.Then(s.GetBroadcastRecipients())).Methods("GET")
+	s.router.Handle("/broadcasts/{id}/pause", c.Then(s.PauseBroadcast())).Methods("POST")
+	s.router.Handle("/broadcasts/{id}/resume", c.Then(s.ResumeBroadcast())).Methods("POST")
+
+	s.router.Handle("/templates", c.Then(s.CreateTemplate())).Methods("POST")
+	s.router.Handle("/templates", c.Then(s.ListTemplates())).Methods("GET")
+	s.router.Handle("/templates/{name}", c.Then(s.GetTemplate())).Methods("GET")
+	s.router.Handle("/templates/{name}", c.Then(s.UpdateTemplate())).Methods("POST")
+	s.router.Handle("/templates/{name}", c.Then(s.DeleteTemplate())).Methods("DELETE")
+	s.router.Handle("/templates/{name}/versions", c.Then(s.GetTemplateVersions())).Methods("GET")
 
 	s.router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
 	s.router.Handle("/group/info", c.Then(s.GetGroupInfo())).Methods("GET")
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// States of a scheduled message. Recurring messages stay scheduled until
+// they are cancelled.
+const (
+	scheduleScheduled = "scheduled"
+	scheduleCompleted = "completed"
+	scheduleFailed    = "failed"
+	scheduleCancelled = "cancelled"
+)
+
+// How often the scheduler looks for due messages, and how many it sends at
+// a time
+const (
+	schedulerPollInterval = 5 * time.Second
+	schedulerBatchSize    = 20
+)
+
+var (
+	errScheduleNotFound  = errors.New("scheduled message not found")
+	errScheduleNotActive = errors.New("scheduled message is no longer scheduled")
+)
+
+// When to send a message, taken from the SendAt, Cron and Timezone fields
+// of a send payload. Cron expressions are evaluated in Timezone, UTC by
+// default.
+type sendSchedule struct {
+	SendAt   time.Time
+	Cron     string
+	Timezone string
+
+	cron *cronSchedule
+}
+
+// Parses the schedule fields of a send payload. Returns nil when the
+// message is to be sent right away.
+func parseSendSchedule(sendAt string, cron string, timezone string) (*sendSchedule, error) {
+	if sendAt == "" && cron == "" {
+		if timezone != "" {
+			return nil, errors.New("Timezone can only be used with Cron")
+		}
+		return nil, nil
+	}
+	if sendAt != "" && cron != "" {
+		return nil, errors.New("only one of SendAt and Cron can be set")
+	}
+
+	if sendAt != "" {
+		if timezone != "" {
+			return nil, errors.New("Timezone can only be used with Cron, SendAt carries its own offset")
+		}
+		t, err := time.Parse(time.RFC3339, sendAt)
+		if err != nil {
+			return nil, errors.New("SendAt must be an RFC3339 time with a timezone offset")
+		}
+		if !t.After(time.Now()) {
+			return nil, errors.New("SendAt must be in the future")
+		}
+		return &sendSchedule{SendAt: t}, nil
+	}
+
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("unknown Timezone %q", timezone)
+		}
+	}
+	c, err := parseCron(cron, loc)
+	if err != nil {
+		return nil, err
+	}
+	ss := &sendSchedule{Cron: cron, Timezone: timezone, cron: c}
+	if ss.nextRun(time.Now()).IsZero() {
+		return nil, errors.New("cron expression never matches")
+	}
+	return ss, nil
+}
+
+// Time of the next send after the given time, zero if there is none
+func (ss *sendSchedule) nextRun(after time.Time) time.Time {
+	if ss.cron != nil {
+		return ss.cron.next(after)
+	}
+	if ss.SendAt.After(after) {
+		return ss.SendAt
+	}
+	return time.Time{}
+}
+
+// Message waiting to be sent at a later time, once or on a cron schedule
+type scheduledMessage struct {
+	Id            string
+	Chat          string
+	Type          string
+	Status        string
+	SendAt        *time.Time `json:",omitempty"`
+	Cron          string     `json:",omitempty"`
+	Timezone      string     `json:",omitempty"`
+	NextRun       *time.Time `json:",omitempty"`
+	LastRun       *time.Time `json:",omitempty"`
+	LastMessageId string     `json:",omitempty"`
+	LastStatus    string     `json:",omitempty"`
+	LastError     string     `json:",omitempty"`
+	Runs          int
+	CreatedAt     time.Time
+
+	message *waProto.Message
+}
+
+func (sm *scheduledMessage) schedule() (*sendSchedule, error) {
+	if sm.Cron == "" {
+		return &sendSchedule{SendAt: *sm.SendAt}, nil
+	}
+	loc := time.UTC
+	if sm.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sm.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	c, err := parseCron(sm.Cron, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &sendSchedule{Cron: sm.Cron, Timezone: sm.Timezone, cron: c}, nil
+}
+
+// Outcome of a run of a scheduled message, posted as a ScheduledSend webhook
+type scheduledSendEvent struct {
+	ScheduleId string
+	MessageId  string
+	Chat       types.JID
+	Status     string
+	Timestamp  time.Time
+	Error      string
+	NextRun    time.Time
+}
+
+type scheduleContextKey struct{}
+
+// Middleware for send endpoints that reads the SendAt, Cron and Timezone
+// fields of the payload. Scheduled requests carry their schedule in the
+// request context, for sendOrQueue to store the message instead of sending it.
+func (s *server) schedulable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var t struct {
+			SendAt   string
+			Cron     string
+			Timezone string
+		}
+		if isMultipartRequest(r) {
+			// The handler parses the form again from memory
+			if err := parseMultipartPayload(w, r); err != nil {
+				s.respondMediaError(w, r, err, errors.New("could not decode Payload"))
+				return
+			}
+			if err := decodeForm(r.MultipartForm.Value, &t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		} else {
+			body, err := readJSONBody(w, r)
+			if err != nil {
+				s.respondMediaError(w, r, err, errors.New("could not read Payload"))
+				return
+			}
+			if json.Unmarshal(body, &t) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		schedule, err := parseSendSchedule(t.SendAt, t.Cron, t.Timezone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if schedule != nil {
+			r = r.WithContext(context.WithValue(r.Context(), scheduleContextKey{}, schedule))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func scheduleFromContext(ctx context.Context) *sendSchedule {
+	schedule, _ := ctx.Value(scheduleContextKey{}).(*sendSchedule)
+	return schedule
+}
+
+// Stores a message to be sent later. The media of media messages is kept
+// along, to upload it again if it expires on the WhatsApp CDN before a run.
+func scheduleMessage(db *sql.DB, userID int, chat types.JID, msg *waProto.Message, id string, ss *sendSchedule, media []byte) (*scheduledMessage, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var sqlStmt, mediaStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO scheduled_messages (user_id, schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		mediaStmt = `INSERT INTO scheduled_media (user_id, schedule_id, data) VALUES (?, ?, ?)`
+	case "postgresql":
+		sqlStmt = `INSERT INTO scheduled_messages (user_id, schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+		mediaStmt = `INSERT INTO scheduled_media (user_id, schedule_id, data) VALUES ($1, $2, $3)`
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(sqlStmt, userID, id, chat.String(), messageType(unwrapMessage(msg)), data, unixMilliOrZero(ss.SendAt), ss.Cron,
+		ss.Timezone, scheduleScheduled, unixMilliOrZero(ss.nextRun(now)), now.UnixMilli()); err != nil {
+		return nil, err
+	}
+	if media != nil {
+		if _, err := tx.Exec(mediaStmt, userID, id, media); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getScheduledMessage(db, userID, id)
+}
+
+// Downloads the media of a message about to be scheduled, nil if it has none
+func scheduledMediaCopy(client *whatsmeow.Client, msg *waProto.Message) ([]byte, error) {
+	_, downloadable := getDownloadable(unwrapMessage(msg))
+	if downloadable == nil {
+		return nil, nil
+	}
+	return client.Download(downloadable)
+}
+
+func getScheduledMedia(db *sql.DB, userID int, id string) ([]byte, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT data FROM scheduled_media WHERE user_id = ? AND schedule_id = ?`, userID, id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT data FROM scheduled_media WHERE user_id = $1 AND schedule_id = $2`, userID, id)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var data []byte
+	if err := row.Scan(&data); errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("media expired and no copy of it was kept")
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Drops the media kept for a scheduled message that will not run again
+func deleteScheduledMedia(db *sql.DB, userID int, id string) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`DELETE FROM scheduled_media WHERE user_id = ? AND schedule_id = ?`, userID, id)
+	case "postgresql":
+		_, err = db.Exec(`DELETE FROM scheduled_media WHERE user_id = $1 AND schedule_id = $2`, userID, id)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Replaces the stored message of a schedule, after its media was uploaded
+// again
+func updateScheduledMessage(db *sql.DB, userID int, id string, msg *waProto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE scheduled_messages SET message = ? WHERE user_id = ? AND schedule_id = ?`, data, userID, id)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE scheduled_messages SET message = $1 WHERE user_id = $2 AND schedule_id = $3`, data, userID, id)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Makes sure the media of a scheduled message can still be downloaded by
+// the recipient. Media expired on the WhatsApp CDN is uploaded again from
+// the copy kept when it was scheduled, and the new upload is stored for
+// later runs.
+func refreshScheduledMedia(client *whatsmeow.Client, db *sql.DB, userID int, sm *scheduledMessage, msg *waProto.Message) error {
+	media := unwrapMessage(msg)
+	mediaType, downloadable := getDownloadable(media)
+	if downloadable == nil {
+		return nil
+	}
+
+	err := probeMedia(client, downloadable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) && !errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		// The media is likely still there, so the send goes ahead
+		log.Warn().Err(err).Str("id", sm.Id).Msg("Failed to check media of scheduled message")
+		return nil
+	}
+
+	data, err := getScheduledMedia(db, userID, sm.Id)
+	if err != nil {
+		return err
+	}
+	uploaded, err := client.Upload(context.Background(), data, uploadMediaType(mediaType))
+	if err != nil {
+		return fmt.Errorf("failed to upload media: %w", err)
+	}
+	setUploadedMedia(media, uploaded, uint64(len(data)))
+	log.Info().Str("id", sm.Id).Msg("Uploaded expired media of scheduled message again")
+	return updateScheduledMessage(db, userID, sm.Id, msg)
+}
+
+func scanScheduledMessage(scan func(dest ...interface{}) error) (*scheduledMessage, error) {
+	var sm scheduledMessage
+	var data []byte
+	var sendAt, nextRun, lastRun, createdAt int64
+	if err := scan(&sm.Id, &sm.Chat, &sm.Type, &data, &sendAt, &sm.Cron, &sm.Timezone, &sm.Status, &nextRun, &lastRun,
+		&sm.LastMessageId, &sm.LastStatus, &sm.LastError, &sm.Runs, &createdAt); err != nil {
+		return nil, err
+	}
+	sm.SendAt = optUnixMilli(sendAt)
+	sm.NextRun = optUnixMilli(nextRun)
+	sm.LastRun = optUnixMilli(lastRun)
+	sm.CreatedAt = time.UnixMilli(createdAt)
+	sm.message = &waProto.Message{}
+	if err := proto.Unmarshal(data, sm.message); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled message %s: %w", sm.Id, err)
+	}
+	return &sm, nil
+}
+
+func getScheduledMessage(db *sql.DB, userID int, id string) (*scheduledMessage, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = ? AND schedule_id = ?`, userID, id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = $1 AND schedule_id = $2`, userID, id)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	sm, err := scanScheduledMessage(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errScheduleNotFound
+	}
+	return sm, err
+}
+
+// Returns the scheduled messages of a user by their next run. Only those
+// still scheduled are returned unless all is set.
+func listScheduledMessages(db *sql.DB, userID int, all bool) ([]scheduledMessage, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = ? AND (? OR status = ?) ORDER BY next_run, created_at`, userID, all, scheduleScheduled)
+	case "postgresql":
+		rows, err = db.Query(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = $1 AND ($2 OR status = $3) ORDER BY next_run, created_at`, userID, all, scheduleScheduled)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []scheduledMessage{}
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *sm)
+	}
+	return messages, rows.Err()
+}
+
+// Returns the scheduled messages of a user whose time has come
+func dueScheduledMessages(db *sql.DB, userID int, now time.Time) ([]scheduledMessage, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = ? AND status = ? AND next_run <= ? ORDER BY next_run LIMIT ?`,
+			userID, scheduleScheduled, now.UnixMilli(), schedulerBatchSize)
+	case "postgresql":
+		rows, err = db.Query(`SELECT schedule_id, chat_jid, type, message, send_at, cron, timezone, status, next_run, last_run,
+				last_message_id, last_status, last_error, runs, created_at
+			FROM scheduled_messages WHERE user_id = $1 AND status = $2 AND next_run <= $3 ORDER BY next_run LIMIT $4`,
+			userID, scheduleScheduled, now.UnixMilli(), schedulerBatchSize)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []scheduledMessage
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *sm)
+	}
+	return messages, rows.Err()
+}
+
+// Changes when a scheduled message is sent
+func rescheduleMessage(db *sql.DB, userID int, id string, ss *sendSchedule) (*scheduledMessage, error) {
+	var res sql.Result
+	var err error
+	switch dbType {
+	case "sqlite3":
+		res, err = db.Exec(`UPDATE scheduled_messages SET send_at = ?, cron = ?, timezone = ?, next_run = ?
+			WHERE user_id = ? AND schedule_id = ? AND status = ?`,
+			unixMilliOrZero(ss.SendAt), ss.Cron, ss.Timezone, unixMilliOrZero(ss.nextRun(time.Now())), userID, id, scheduleScheduled)
+	case "postgresql":
+		res, err = db.Exec(`UPDATE scheduled_messages SET send_at = $1, cron = $2, timezone = $3, next_run = $4
+			WHERE user_id = $5 AND schedule_id = $6 AND status = $7`,
+			unixMilliOrZero(ss.SendAt), ss.Cron, ss.Timezone, unixMilliOrZero(ss.nextRun(time.Now())), userID, id, scheduleScheduled)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if _, err := getScheduledMessage(db, userID, id); err != nil {
+			return nil, err
+		}
+		return nil, errScheduleNotActive
+	}
+	return getScheduledMessage(db, userID, id)
+}
+
+func cancelScheduledMessage(db *sql.DB, userID int, id string) error {
+	var res sql.Result
+	var err error
+	switch dbType {
+	case "sqlite3":
+		res, err = db.Exec(`UPDATE scheduled_messages SET status = ?, next_run = 0 WHERE user_id = ? AND schedule_id = ? AND status = ?`,
+			scheduleCancelled, userID, id, scheduleScheduled)
+	case "postgresql":
+		res, err = db.Exec(`UPDATE scheduled_messages SET status = $1, next_run = 0 WHERE user_id = $2 AND schedule_id = $3 AND status = $4`,
+			scheduleCancelled, userID, id, scheduleScheduled)
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := getScheduledMessage(db, userID, id); err != nil {
+			return err
+		}
+		return errScheduleNotActive
+	}
+	return deleteScheduledMedia(db, userID, id)
+}
+
+// Records a run of a scheduled message and when it runs next
+func recordScheduledRun(db *sql.DB, userID int, id string, status string, nextRun time.Time, run *scheduledSendEvent) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE scheduled_messages SET status = ?, next_run = ?, last_run = ?, last_message_id = ?, last_status = ?,
+				last_error = ?, runs = runs + 1
+			WHERE user_id = ? AND schedule_id = ? AND status = ?`,
+			status, unixMilliOrZero(nextRun), run.Timestamp.UnixMilli(), run.MessageId, run.Status, run.Error, userID, id, scheduleScheduled)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE scheduled_messages SET status = $1, next_run = $2, last_run = $3, last_message_id = $4, last_status = $5,
+				last_error = $6, runs = runs + 1
+			WHERE user_id = $7 AND schedule_id = $8 AND status = $9`,
+			status, unixMilliOrZero(nextRun), run.Timestamp.UnixMilli(), run.MessageId, run.Status, run.Error, userID, id, scheduleScheduled)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Sends the scheduled messages of a session when they are due, until stop
+// is closed. Messages that came due while the session was down are sent
+// once when it is back, and recurring ones then resume their schedule.
+func (s *server) runScheduler(mycli *MyClient, stop <-chan struct{}) {
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		client := mycli.WAClient
+		if !client.IsConnected() || client.Store.ID == nil {
+			continue
+		}
+		due, err := dueScheduledMessages(s.db, mycli.userID, time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get due scheduled messages")
+			continue
+		}
+		for i := range due {
+			s.runScheduledMessage(mycli, &due[i])
+		}
+	}
+}
+
+// Sends a due scheduled message through the regular send path, which
+// queues it when queued mode is on, and reports the outcome
+func (s *server) runScheduledMessage(mycli *MyClient, sm *scheduledMessage) {
+	run := scheduledSendEvent{ScheduleId: sm.Id, MessageId: sm.Id, Status: queueSent}
+
+	// Every run of a recurring message is a new message
+	recurring := sm.Cron != ""
+	if recurring {
+		run.MessageId = mycli.WAClient.GenerateMessageID()
+	}
+
+	schedule, err := sm.schedule()
+	var chat types.JID
+	if err == nil {
+		chat, err = types.ParseJID(sm.Chat)
+	}
+	msg := proto.Clone(sm.message).(*waProto.Message)
+	if err == nil {
+		run.Chat = chat
+		err = refreshScheduledMedia(mycli.WAClient, s.db, mycli.userID, sm, msg)
+	}
+	if err == nil {
+		var outcome sendOutcome
+		outcome, err = s.sendOrQueue(context.Background(), mycli.userID, run.Chat, msg, run.MessageId)
+		run.Timestamp = outcome.Resp.Timestamp
+		if outcome.Queued {
+			run.Status = queuePending
+		}
+	}
+	if run.Timestamp.IsZero() {
+		run.Timestamp = time.Now()
+	}
+
+	status := scheduleCompleted
+	if err != nil {
+		run.Status = queueFailed
+		run.Error = err.Error()
+		status = scheduleFailed
+		log.Error().Err(err).Str("id", sm.Id).Msg("Failed to send scheduled message")
+	} else {
+		log.Info().Str("id", sm.Id).Str("message", run.MessageId).Str("status", run.Status).Msg("Scheduled message sent")
+	}
+	if recurring && schedule != nil {
+		if run.NextRun = schedule.nextRun(time.Now()); !run.NextRun.IsZero() {
+			status = scheduleScheduled
+		}
+	}
+
+	if err := recordScheduledRun(s.db, mycli.userID, sm.Id, status, run.NextRun, &run); err != nil {
+		log.Error().Err(err).Str("id", sm.Id).Msg("Failed to record scheduled run")
+	}
+	if status != scheduleScheduled {
+		if err := deleteScheduledMedia(s.db, mycli.userID, sm.Id); err != nil {
+			log.Error().Err(err).Str("id", sm.Id).Msg("Failed to delete media of scheduled message")
+		}
+	}
+	mycli.myEventHandler(&run)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Matches @<number> mentions in text and captions
+var mentionRegex = regexp.MustCompile(`(?:^|[^\w@])@(\d{5,15})\b`)
+
+// Builds the ContextInfo for an outgoing message from the ContextInfo in the
+// request payload. When replying, the quoted message is taken from the local
+// message index so the reply shows the real content, and the Participant can
+// be omitted. Numbers mentioned as @<number> in text are added to the
+// MentionedJid list. Returns nil when the message needs no context.
+func (s *server) buildContextInfo(userid int, chat types.JID, in *waProto.ContextInfo, text string) (*waProto.ContextInfo, error) {
+	var ci waProto.ContextInfo
+
+	if in.StanzaId != nil {
+		ci.StanzaId = proto.String(*in.StanzaId)
+		if in.Participant != nil {
+			participant, ok := parseJID(*in.Participant)
+			if *in.Participant == "" || !ok {
+				return nil, errors.New("could not parse Participant in ContextInfo")
+			}
+			ci.Participant = proto.String(participant.String())
+		}
+		ci.QuotedMessage = &waProto.Message{Conversation: proto.String("")}
+
+		quoted, err := getIndexedMessage(s.db, userid, chat.String(), *in.StanzaId)
+		if err == nil {
+			ci.QuotedMessage = quotedCopy(quoted.Message)
+			if ci.Participant == nil && !quoted.Sender.IsEmpty() {
+				ci.Participant = proto.String(quoted.Sender.ToNonAD().String())
+			}
+		} else if !errors.Is(err, errMessageNotIndexed) {
+			log.Warn().Err(err).Str("id", *in.StanzaId).Msg("Failed to look up quoted message")
+		}
+		if ci.Participant == nil {
+			return nil, errors.New("missing Participant in ContextInfo")
+		}
+	}
+
+	seen := make(map[string]bool)
+	addMention := func(jid types.JID) {
+		if !seen[jid.String()] {
+			seen[jid.String()] = true
+			ci.MentionedJid = append(ci.MentionedJid, jid.String())
+		}
+	}
+	for _, mention := range in.MentionedJid {
+		jid, ok := types.JID{}, false
+		if mention != "" {
+			jid, ok = parseJID(mention)
+		}
+		if !ok {
+			return nil, fmt.Errorf("could not parse %q in MentionedJid", mention)
+		}
+		addMention(jid)
+	}
+	for _, match := range mentionRegex.FindAllStringSubmatch(text, -1) {
+		addMention(types.NewJID(match[1], types.DefaultUserServer))
+	}
+
+	if ci.StanzaId == nil && len(ci.MentionedJid) == 0 {
+		return nil, nil
+	}
+	return &ci, nil
+}
+
+// Copy of a message suitable for embedding as a quote, without its own context
+func quotedCopy(msg *waProto.Message) *waProto.Message {
+	quoted := proto.Clone(msg).(*waProto.Message)
+	quoted.MessageContextInfo = nil
+	setContextInfo(quoted, nil)
+	return quoted
+}
+
+// Attaches ci to the sub message of msg that carries the content. Plain
+// conversation messages are turned into extended text messages, which are
+// the only text messages able to carry a context.
+func setContextInfo(msg *waProto.Message, ci *waProto.ContextInfo) {
+	switch {
+	case msg.Conversation != nil:
+		if ci != nil {
+			msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: msg.Conversation, ContextInfo: ci}
+			msg.Conversation = nil
+		}
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = ci
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = ci
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = ci
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = ci
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = ci
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = ci
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = ci
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = ci
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = ci
+	case msg.LiveLocationMessage != nil:
+		msg.LiveLocationMessage.ContextInfo = ci
+	case msg.PollCreationMessage != nil:
+		msg.PollCreationMessage.ContextInfo = ci
+	case msg.PollCreationMessageV2 != nil:
+		msg.PollCreationMessageV2.ContextInfo = ci
+	case msg.PollCreationMessageV3 != nil:
+		msg.PollCreationMessageV3.ContextInfo = ci
+	case msg.ListMessage != nil:
+		msg.ListMessage.ContextInfo = ci
+	case msg.ButtonsMessage != nil:
+		msg.ButtonsMessage.ContextInfo = ci
+	}
+}
+
+// Returns the context of the sub message of msg that carries the content
+func getContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.GetContextInfo()
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.GetContextInfo()
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.GetContextInfo()
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage.GetContextInfo()
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.GetContextInfo()
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage.GetContextInfo()
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.GetContextInfo()
+	case msg.ContactsArrayMessage != nil:
+		return msg.ContactsArrayMessage.GetContextInfo()
+	case msg.LocationMessage != nil:
+		return msg.LocationMessage.GetContextInfo()
+	case msg.LiveLocationMessage != nil:
+		return msg.LiveLocationMessage.GetContextInfo()
+	case msg.PollCreationMessage != nil:
+		return msg.PollCreationMessage.GetContextInfo()
+	case msg.PollCreationMessageV2 != nil:
+		return msg.PollCreationMessageV2.GetContextInfo()
+	case msg.PollCreationMessageV3 != nil:
+		return msg.PollCreationMessageV3.GetContextInfo()
+	case msg.ListMessage != nil:
+		return msg.ListMessage.GetContextInfo()
+	case msg.ButtonsMessage != nil:
+		return msg.ButtonsMessage.GetContextInfo()
+	}
+	return nil
+}
+
+// Wraps a media message so it can only be opened once by the recipient.
+// Voice notes go in the V2 extension container, images and videos in V2.
+func wrapViewOnce(msg *waProto.Message) *waProto.Message {
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ViewOnce = proto.Bool(true)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ViewOnce = proto.Bool(true)
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ViewOnce = proto.Bool(true)
+	}
+	if msg.AudioMessage != nil {
+		return &waProto.Message{ViewOnceMessageV2Extension: &waProto.FutureProofMessage{Message: msg}}
+	}
+	return &waProto.Message{ViewOnceMessageV2: &waProto.FutureProofMessage{Message: msg}}
+}
+
+// Sends a message and records it in the local message index and, when
+// enabled, the message store, and starts tracking its delivery. Every
+// /chat/send endpoint goes through here.
+// Messages to chats with a known disappearing timer are sent with the
+// matching expiration.
+func (s *server) sendMessage(ctx context.Context, userid int, recipient types.JID, msg *waProto.Message, msgid string) (whatsmeow.SendResponse, error) {
+	client := clientPointer[userid]
+	if client == nil {
+		return whatsmeow.SendResponse{}, errors.New("no session")
+	}
+
+	if msg.ProtocolMessage == nil && msg.ReactionMessage == nil && msg.EditedMessage == nil {
+		timer, err := getDisappearingTimer(s.db, userid, recipient)
+		if err != nil {
+			log.Warn().Err(err).Str("chat", recipient.String()).Msg("Failed to look up disappearing timer")
+		} else if timer > 0 {
+			setExpiration(unwrapMessage(msg), timer)
+		}
+	}
+
+	sentAt := time.Now()
+	resp, err := client.SendMessage(ctx, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+	if err != nil {
+		return resp, err
+	}
+
+	// Read once for everything the message is kept in
+	stored := messageStoreEnabled(s.db, userid)
+
+	// Edits update the original message, reactions and other protocol
+	// messages have no content of their own to index
+	if edit := msg.GetEditedMessage().GetMessage().GetProtocolMessage(); edit != nil {
+		if _, err := indexEdit(s.db, userid, recipient, edit, stored); err != nil && !errors.Is(err, errMessageNotIndexed) {
+			log.Error().Err(err).Str("id", edit.GetKey().GetId()).Msg("Failed to index edited message")
+		}
+		if stored {
+			if err := storeProtocolMessage(s.db, userid, recipient, edit); err != nil {
+				log.Error().Err(err).Str("id", edit.GetKey().GetId()).Msg("Failed to store edited message")
+			}
+		}
+		return resp, nil
+	}
+	if msg.ProtocolMessage != nil {
+		if stored {
+			if err := storeProtocolMessage(s.db, userid, recipient, msg.ProtocolMessage); err != nil {
+				log.Error().Err(err).Str("id", msg.ProtocolMessage.GetKey().GetId()).Msg("Failed to store revoked message")
+			}
+		}
+		return resp, nil
+	}
+	if msg.ReactionMessage != nil {
+		return resp, nil
+	}
+
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     recipient,
+			IsFromMe: true,
+			IsGroup:  recipient.Server == types.GroupServer,
+		},
+		ID:        msgid,
+		Timestamp: resp.Timestamp,
+	}
+	if client.Store.ID != nil {
+		info.Sender = client.Store.ID.ToNonAD()
+	}
+	if err := indexMessage(s.db, userid, info, unwrapMessage(msg), stored); err != nil {
+		log.Error().Err(err).Str("id", msgid).Msg("Failed to index sent message")
+	}
+	if stored {
+		if _, err := storeMessage(s.db, userid, info, unwrapMessage(msg)); err != nil {
+			log.Error().Err(err).Str("id", msgid).Msg("Failed to store sent message")
+		}
+	}
+	if err := touchChat(s.db, userid, recipient, resp.Timestamp, true); err != nil {
+		log.Error().Err(err).Str("chat", recipient.String()).Msg("Failed to update chat")
+	}
+	if err := trackSentMessage(s.db, userid, recipient, msgid, sentAt, resp.Timestamp); err != nil {
+		log.Error().Err(err).Str("id", msgid).Msg("Failed to track message status")
+	}
+	return resp, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Delivery states of a sent message, in the order they are reached
+const (
+	statusServerAck = "server_ack"
+	statusDelivered = "delivered"
+	statusRead      = "read"
+	statusPlayed    = "played"
+)
+
+var errMessageStatusNotFound = errors.New("message status not found")
+
+// Receipt types that move a message forward, with the column recording
+// them. Reaching a state implies the earlier ones, which are filled in with
+// the same time when the phone skipped their receipts.
+var receiptStatusColumns = []struct {
+	receipt types.ReceiptType
+	status  string
+	column  string
+}{
+	{types.ReceiptTypeDelivered, statusDelivered, "delivered_at"},
+	{types.ReceiptTypeRead, statusRead, "read_at"},
+	{types.ReceiptTypePlayed, statusPlayed, "played_at"},
+}
+
+// Delivery state of a message for a single group participant
+type participantStatus struct {
+	Jid       string
+	Status    string
+	Delivered *time.Time `json:",omitempty"`
+	Read      *time.Time `json:",omitempty"`
+	Played    *time.Time `json:",omitempty"`
+}
+
+// Delivery state of a message sent through the API. In groups the message
+// is delivered, read or played as soon as one participant got that far.
+type messageStatus struct {
+	Id           string
+	Chat         string
+	Status       string
+	Sent         time.Time
+	ServerAck    *time.Time          `json:",omitempty"`
+	Delivered    *time.Time          `json:",omitempty"`
+	Read         *time.Time          `json:",omitempty"`
+	Played       *time.Time          `json:",omitempty"`
+	Participants []participantStatus `json:",omitempty"`
+}
+
+// Change in the delivery state of a sent message, posted as a MessageStatus
+// webhook. Participant is only set in groups.
+type messageStatusEvent struct {
+	Id          string
+	Chat        types.JID
+	Participant types.JID
+	Status      string
+	Timestamp   time.Time
+}
+
+// Starts tracking the delivery of a message sent through the API
+func trackSentMessage(db *sql.DB, userID int, chat types.JID, id string, sentAt time.Time, ackAt time.Time) error {
+	var sqlStmt string
+	switch dbType {
+	case "sqlite3":
+		sqlStmt = `INSERT INTO message_status (user_id, chat_jid, message_id, participant_jid, sent_at, server_ack_at)
+			VALUES (?, ?, ?, '', ?, ?) ON CONFLICT DO NOTHING`
+	case "postgresql":
+		sqlStmt = `INSERT INTO message_status (user_id, chat_jid, message_id, participant_jid, sent_at, server_ack_at)
+			VALUES ($1, $2, $3, '', $4, $5) ON CONFLICT DO NOTHING`
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	_, err := db.Exec(sqlStmt, userID, chat.ToNonAD().String(), id, sentAt.UnixMilli(), unixMilliOrZero(ackAt))
+	return err
+}
+
+// Records a delivery, read or played receipt for tracked messages and
+// returns the changes it caused. Receipts for messages not sent through the
+// API, and receipts from the user's own devices, are ignored.
+func applyReceipt(db *sql.DB, userID int, evt *events.Receipt) ([]messageStatusEvent, error) {
+	if evt.IsFromMe {
+		return nil, nil
+	}
+	index := -1
+	for i, rs := range receiptStatusColumns {
+		if rs.receipt == evt.Type {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, nil
+	}
+	status := receiptStatusColumns[index].status
+
+	chat := evt.Chat.ToNonAD()
+	participant := ""
+	if evt.IsGroup {
+		participant = evt.Sender.ToNonAD().String()
+	}
+
+	var changes []messageStatusEvent
+	for _, id := range evt.MessageIDs {
+		tracked, err := isTrackedMessage(db, userID, chat, id)
+		if err != nil {
+			return changes, err
+		}
+		if !tracked {
+			continue
+		}
+
+		changed, err := advanceMessageStatus(db, userID, chat, id, "", index, evt.Timestamp)
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			if err := updateStoredMessageStatus(db, userID, chat, id, status); err != nil {
+				log.Warn().Err(err).Str("id", id).Msg("Failed to update stored message status")
+			}
+		}
+
+		if participant != "" {
+			changed, err = advanceMessageStatus(db, userID, chat, id, participant, index, evt.Timestamp)
+			if err != nil {
+				return changes, err
+			}
+		}
+		if changed {
+			change := messageStatusEvent{Id: id, Chat: chat, Status: status, Timestamp: evt.Timestamp}
+			if participant != "" {
+				change.Participant = evt.Sender.ToNonAD()
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func isTrackedMessage(db *sql.DB, userID int, chat types.JID, id string) (bool, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT 1 FROM message_status WHERE user_id = ? AND chat_jid = ? AND message_id = ? AND participant_jid = ''`,
+			userID, chat.String(), id)
+	case "postgresql":
+		row = db.QueryRow(`SELECT 1 FROM message_status WHERE user_id = $1 AND chat_jid = $2 AND message_id = $3 AND participant_jid = ''`,
+			userID, chat.String(), id)
+	default:
+		return false, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	var one int
+	if err := row.Scan(&one); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Sets the time of the state at index in receiptStatusColumns for the
+// message, or one of its participants, if it was not reached before.
+// Returns whether the state changed.
+func advanceMessageStatus(db *sql.DB, userID int, chat types.JID, id string, participant string, index int, timestamp time.Time) (bool, error) {
+	column := receiptStatusColumns[index].column
+	ts := unixMilliOrZero(timestamp)
+	if ts == 0 {
+		ts = time.Now().UnixMilli()
+	}
+
+	var insertStmt, updateStmt string
+	switch dbType {
+	case "sqlite3":
+		insertStmt = `INSERT INTO message_status (user_id, chat_jid, message_id, participant_jid) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`
+		updateStmt = `UPDATE message_status SET ` + column + ` = ?`
+		for _, earlier := range receiptStatusColumns[:index] {
+			updateStmt += `, ` + earlier.column + ` = CASE WHEN ` + earlier.column + ` = 0 THEN ? ELSE ` + earlier.column + ` END`
+		}
+		updateStmt += ` WHERE user_id = ? AND chat_jid = ? AND message_id = ? AND participant_jid = ? AND ` + column + ` = 0`
+	case "postgresql":
+		insertStmt = `INSERT INTO message_status (user_id, chat_jid, message_id, participant_jid) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+		updateStmt = `UPDATE message_status SET ` + column + ` = $1`
+		n := 2
+		for _, earlier := range receiptStatusColumns[:index] {
+			updateStmt += fmt.Sprintf(`, %s = CASE WHEN %s = 0 THEN $%d ELSE %s END`, earlier.column, earlier.column, n, earlier.column)
+			n++
+		}
+		updateStmt += fmt.Sprintf(` WHERE user_id = $%d AND chat_jid = $%d AND message_id = $%d AND participant_jid = $%d AND %s = 0`,
+			n, n+1, n+2, n+3, column)
+	default:
+		return false, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	if participant != "" {
+		if _, err := db.Exec(insertStmt, userID, chat.String(), id, participant); err != nil {
+			return false, err
+		}
+	}
+
+	args := []interface{}{ts}
+	for range receiptStatusColumns[:index] {
+		args = append(args, ts)
+	}
+	args = append(args, userID, chat.String(), id, participant)
+	res, err := db.Exec(updateStmt, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+// Mirrors the delivery state of a sent message in the message store
+func updateStoredMessageStatus(db *sql.DB, userID int, chat types.JID, id string, status string) error {
+	var err error
+	switch dbType {
+	case "sqlite3":
+		_, err = db.Exec(`UPDATE messages SET status = ? WHERE user_id = ? AND chat_jid = ? AND message_id = ? AND from_me`,
+			status, userID, chat.String(), id)
+	case "postgresql":
+		_, err = db.Exec(`UPDATE messages SET status = $1 WHERE user_id = $2 AND chat_jid = $3 AND message_id = $4 AND from_me`,
+			status, userID, chat.String(), id)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	return err
+}
+
+// Returns the delivery state of a message sent through the API. When chat
+// is empty the message is looked up in every chat.
+func getMessageStatus(db *sql.DB, userID int, chat string, id string) (*messageStatus, error) {
+	var rows *sql.Rows
+	var err error
+	switch dbType {
+	case "sqlite3":
+		rows, err = db.Query(`SELECT chat_jid, participant_jid, sent_at, server_ack_at, delivered_at, read_at, played_at
+			FROM message_status WHERE user_id = ? AND message_id = ? AND (? = '' OR chat_jid = ?)
+			ORDER BY chat_jid, participant_jid`, userID, id, chat, chat)
+	case "postgresql":
+		rows, err = db.Query(`SELECT chat_jid, participant_jid, sent_at, server_ack_at, delivered_at, read_at, played_at
+			FROM message_status WHERE user_id = $1 AND message_id = $2 AND ($3 = '' OR chat_jid = $3)
+			ORDER BY chat_jid, participant_jid`, userID, id, chat)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var status *messageStatus
+	for rows.Next() {
+		var chatJID, participant string
+		var sent, ack, delivered, read, played int64
+		if err := rows.Scan(&chatJID, &participant, &sent, &ack, &delivered, &read, &played); err != nil {
+			return nil, err
+		}
+		// The same ID in another chat belongs to a different message
+		if status != nil && chatJID != status.Chat {
+			break
+		}
+		if participant == "" {
+			status = &messageStatus{
+				Id:        id,
+				Chat:      chatJID,
+				Status:    statusSent,
+				Sent:      time.UnixMilli(sent),
+				ServerAck: optUnixMilli(ack),
+				Delivered: optUnixMilli(delivered),
+				Read:      optUnixMilli(read),
+				Played:    optUnixMilli(played),
+			}
+			status.Status = latestStatus(status.ServerAck, status.Delivered, status.Read, status.Played)
+			continue
+		}
+		if status == nil {
+			continue
+		}
+		p := participantStatus{
+			Jid:       participant,
+			Delivered: optUnixMilli(delivered),
+			Read:      optUnixMilli(read),
+			Played:    optUnixMilli(played),
+		}
+		p.Status = latestStatus(nil, p.Delivered, p.Read, p.Played)
+		status.Participants = append(status.Participants, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, errMessageStatusNotFound
+	}
+	return status, nil
+}
+
+// Name of the furthest state reached
+func latestStatus(ack, delivered, read, played *time.Time) string {
+	switch {
+	case played != nil:
+		return statusPlayed
+	case read != nil:
+		return statusRead
+	case delivered != nil:
+		return statusDelivered
+	case ack != nil:
+		return statusServerAck
+	}
+	return statusSent
+}
+
+func optUnixMilli(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.UnixMilli(ms)
+	return &t
+}
+
+func unixMilliOrZero(t time.Time) int64 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return t.UnixMilli()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Stickers are displayed on a square canvas of this size
+const stickerSize = 512
+
+// A sticker ready to be uploaded
+type sticker struct {
+	Data     []byte
+	Animated bool
+}
+
+// Sticker pack information stored in the EXIF chunk of the WebP file
+type stickerMeta struct {
+	PackName   string
+	PackAuthor string
+	Emojis     []string
+}
+
+// Converts an image to a 512x512 WebP sticker carrying the pack metadata.
+// Static images are resized, padded with transparency and encoded as lossless
+// WebP. Animated WebP files are kept as they are, apart from the metadata.
+func makeSticker(data []byte, meta stickerMeta) (*sticker, error) {
+	exif, err := stickerExif(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunks, err := parseWebPChunks(data); err == nil && len(chunks) > 0 &&
+		chunks[0].ID == "VP8X" && len(chunks[0].Data) >= 10 && chunks[0].Data[0]&vp8xFlagAnimation != 0 {
+		return makeAnimatedSticker(chunks, exif)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode sticker image: %w", err)
+	}
+	if cfg.Width*cfg.Height > maxPreviewPixels {
+		return nil, fmt.Errorf("sticker image too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode sticker image: %w", err)
+	}
+
+	bitstream, err := encodeVP8L(padToSquare(img, stickerSize))
+	if err != nil {
+		return nil, err
+	}
+	return &sticker{
+		Data: buildWebP([]riffChunk{
+			vp8xChunk(vp8xFlagAlpha|vp8xFlagEXIF, stickerSize, stickerSize),
+			{ID: "VP8L", Data: bitstream},
+			{ID: "EXIF", Data: exif},
+		}),
+	}, nil
+}
+
+// Replaces the metadata of an animated WebP sticker
+func makeAnimatedSticker(chunks []riffChunk, exif []byte) (*sticker, error) {
+	vp8x := chunks[0].Data
+	width, height := uint24(vp8x[4:7])+1, uint24(vp8x[7:10])+1
+	if width != stickerSize || height != stickerSize {
+		return nil, fmt.Errorf("animated stickers must be %dx%d, got %dx%d", stickerSize, stickerSize, width, height)
+	}
+
+	flags := vp8x[0] | vp8xFlagEXIF
+	out := []riffChunk{vp8xChunk(flags, width, height)}
+	for _, c := range chunks[1:] {
+		if c.ID != "EXIF" {
+			out = append(out, c)
+		}
+	}
+	out = append(out, riffChunk{ID: "EXIF", Data: exif})
+	return &sticker{Data: buildWebP(out), Animated: true}, nil
+}
+
+// Fits img in a transparent square canvas, preserving its aspect ratio
+func padToSquare(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	x, y := (size-width)/2, (size-height)/2
+	draw.CatmullRom.Scale(dst, image.Rect(x, y, x+width, y+height), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// Builds the EXIF payload WhatsApp reads the sticker pack information from.
+// It is a little endian TIFF header with a single IFD entry of tag 0x5741
+// holding the JSON metadata.
+func stickerExif(meta stickerMeta) ([]byte, error) {
+	packID := sha256.Sum256([]byte(meta.PackName + "\x00" + meta.PackAuthor))
+	emojis := meta.Emojis
+	if emojis == nil {
+		emojis = []string{}
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"sticker-pack-id":        hex.EncodeToString(packID[:16]),
+		"sticker-pack-name":      meta.PackName,
+		"sticker-pack-publisher": meta.PackAuthor,
+		"emojis":                 emojis,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > 0xffff {
+		return nil, errors.New("sticker metadata too long")
+	}
+
+	exif := []byte{
+		0x49, 0x49, 0x2a, 0x00, 0x08, 0x00, 0x00, 0x00, // TIFF header, IFD at offset 8
+		0x01, 0x00, // one entry
+		0x41, 0x57, 0x07, 0x00, // tag 0x5741, type UNDEFINED
+		0, 0, 0, 0, // length
+		0x16, 0x00, 0x00, 0x00, // value offset, right after the entry
+	}
+	binary.LittleEndian.PutUint32(exif[14:18], uint32(len(payload)))
+	return append(exif, payload...), nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of media a template can hold, named as the send endpoints
+var templateMediaTypes = []string{"image", "video", "audio", "document"}
+
+var templateNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,100}$`)
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	errTemplateExists   = errors.New("template already exists")
+	errTemplateChanged  = errors.New("template changed while saving it, try again")
+)
+
+// How many times saving a new version is tried when other updates of the
+// same template get in first
+const templateSaveAttempts = 3
+
+// Named message kept on the server, sent with variables filled in. Every
+// update is stored as a new version. Body is the text of the message, the
+// caption of its media or the title of its buttons or list. Only buttons
+// and lists have a Footer.
+type messageTemplate struct {
+	Name      string
+	Version   int
+	Body      string
+	Footer    string           `json:",omitempty"`
+	Media     *templateMedia   `json:",omitempty"`
+	Buttons   []templateButton `json:",omitempty"`
+	List      *templateList    `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+// Media of a template, as a base64 data URL or a http(s) URL
+type templateMedia struct {
+	Type     string
+	Url      string
+	FileName string `json:",omitempty"`
+}
+
+type templateButton struct {
+	ButtonId   string
+	ButtonText string
+}
+
+type templateList struct {
+	Description string
+	ButtonText  string
+	Sections    []templateListSection
+}
+
+type templateListSection struct {
+	Title string
+	Rows  []templateListRow
+}
+
+type templateListRow struct {
+	RowId       string
+	Title       string
+	Description string `json:",omitempty"`
+}
+
+// Parses a message body with {{.variable}} placeholders. Variables missing
+// for a recipient are an error instead of rendering as empty text.
+func parseMessageTemplate(body string) (*template.Template, error) {
+	return template.New("message").Option("missingkey=error").Parse(body)
+}
+
+func renderMessageTemplate(tmpl *template.Template, variables map[string]string) (string, error) {
+	if variables == nil {
+		variables = map[string]string{}
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, variables); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Fills in the text fields of a template, keeping the first error
+type templateRenderer struct {
+	variables map[string]string
+	err       error
+}
+
+func (tr *templateRenderer) render(text string) string {
+	if tr.err != nil || text == "" {
+		return text
+	}
+	tmpl, err := parseMessageTemplate(text)
+	if err == nil {
+		text, err = renderMessageTemplate(tmpl, tr.variables)
+	}
+	tr.err = err
+	return text
+}
+
+// Checks that a template is complete and its text fields parse
+func (mt *messageTemplate) validate() error {
+	if !templateNameRegex.MatchString(mt.Name) {
+		return errors.New("Name must be 1 to 100 letters, digits, dots, dashes or underscores")
+	}
+
+	kinds := 0
+	if mt.Media != nil {
+		kinds++
+	}
+	if len(mt.Buttons) > 0 {
+		kinds++
+	}
+	if mt.List != nil {
+		kinds++
+	}
+	if kinds > 1 {
+		return errors.New("a template can only have one of Media, Buttons and List")
+	}
+
+	if mt.Footer != "" && len(mt.Buttons) == 0 && mt.List == nil {
+		return errors.New("Footer can only be used with Buttons or List")
+	}
+
+	switch {
+	case mt.Media != nil:
+		valid := false
+		for _, mediaType := range templateMediaTypes {
+			valid = valid || mt.Media.Type == mediaType
+		}
+		if !valid {
+			return fmt.Errorf("Media Type must be one of %s", strings.Join(templateMediaTypes, ", "))
+		}
+		if mt.Media.Url == "" {
+			return errors.New("missing Media Url in Payload")
+		}
+	case len(mt.Buttons) > 0:
+		if mt.Body == "" {
+			return errors.New("missing Body in Payload")
+		}
+		if len(mt.Buttons) > 3 {
+			return errors.New("a template can have at most 3 Buttons")
+		}
+	case mt.List != nil:
+		if mt.Body == "" {
+			return errors.New("missing Body in Payload")
+		}
+		if mt.List.Description == "" || mt.List.ButtonText == "" || len(mt.List.Sections) == 0 {
+			return errors.New("List needs Description, ButtonText and Sections")
+		}
+	default:
+		if mt.Body == "" {
+			return errors.New("missing Body in Payload")
+		}
+	}
+
+	for _, text := range mt.texts() {
+		if _, err := parseMessageTemplate(text); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	return nil
+}
+
+// Text fields of a template that can hold variables
+func (mt *messageTemplate) texts() []string {
+	texts := []string{mt.Body, mt.Footer}
+	if mt.Media != nil {
+		texts = append(texts, mt.Media.Url, mt.Media.FileName)
+	}
+	for _, button := range mt.Buttons {
+		texts = append(texts, button.ButtonId, button.ButtonText)
+	}
+	if mt.List != nil {
+		texts = append(texts, mt.List.Description, mt.List.ButtonText)
+		for _, section := range mt.List.Sections {
+			texts = append(texts, section.Title)
+			for _, row := range section.Rows {
+				texts = append(texts, row.RowId, row.Title, row.Description)
+			}
+		}
+	}
+	return texts
+}
+
+// Renders a template into the payload of the send endpoint for its kind of
+// message, which is returned as well: text, image, video, audio, document,
+// buttons or list
+func (mt *messageTemplate) render(variables map[string]string) (string, map[string]interface{}, error) {
+	tr := &templateRenderer{variables: variables}
+	kind := "text"
+	payload := map[string]interface{}{}
+
+	switch {
+	case mt.Media != nil:
+		kind = mt.Media.Type
+		field := strings.ToUpper(kind[:1]) + kind[1:]
+		payload[field] = tr.render(mt.Media.Url)
+		payload["Caption"] = tr.render(mt.Body)
+		if mt.Media.Type == "document" {
+			payload["FileName"] = tr.render(mt.Media.FileName)
+		}
+	case len(mt.Buttons) > 0:
+		kind = "buttons"
+		payload["Title"] = tr.render(mt.Body)
+		buttons := make([]templateButton, len(mt.Buttons))
+		for i, button := range mt.Buttons {
+			buttons[i] = templateButton{ButtonId: tr.render(button.ButtonId), ButtonText: tr.render(button.ButtonText)}
+		}
+		payload["Buttons"] = buttons
+		payload["FooterText"] = tr.render(mt.Footer)
+	case mt.List != nil:
+		kind = "list"
+		payload["Title"] = tr.render(mt.Body)
+		payload["Description"] = tr.render(mt.List.Description)
+		payload["ButtonText"] = tr.render(mt.List.ButtonText)
+		payload["FooterText"] = tr.render(mt.Footer)
+		sections := make([]templateListSection, len(mt.List.Sections))
+		for i, section := range mt.List.Sections {
+			sections[i].Title = tr.render(section.Title)
+			for _, row := range section.Rows {
+				sections[i].Rows = append(sections[i].Rows, templateListRow{
+					RowId:       tr.render(row.RowId),
+					Title:       tr.render(row.Title),
+					Description: tr.render(row.Description),
+				})
+			}
+		}
+		payload["Sections"] = sections
+	default:
+		payload["Body"] = tr.render(mt.Body)
+	}
+
+	if tr.err != nil {
+		return "", nil, tr.err
+	}
+	return kind, payload, nil
+}
+
+// Stores a template as its first version, or as a new version of an
+// existing one when update is set
+func saveTemplate(db *sql.DB, userID int, mt *messageTemplate, update bool) error {
+	for attempt := 0; attempt < templateSaveAttempts; attempt++ {
+		saved, err := insertTemplateVersion(db, userID, mt, update)
+		if err != nil || saved {
+			return err
+		}
+		// Another request stored the same version first
+		if !update {
+			return errTemplateExists
+		}
+	}
+	return errTemplateChanged
+}
+
+// Inserts the version after the latest one of a template. Returns false
+// when that version was stored by someone else in the meantime.
+func insertTemplateVersion(db *sql.DB, userID int, mt *messageTemplate, update bool) (bool, error) {
+	content, err := json.Marshal(mt)
+	if err != nil {
+		return false, err
+	}
+
+	var versionStmt, insertStmt string
+	switch dbType {
+	case "sqlite3":
+		versionStmt = `SELECT COALESCE(MAX(version), 0) FROM message_templates WHERE user_id = ? AND name = ?`
+		insertStmt = `INSERT INTO message_templates (user_id, name, version, content, created_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, name, version) DO NOTHING`
+	case "postgresql":
+		versionStmt = `SELECT COALESCE(MAX(version), 0) FROM message_templates WHERE user_id = $1 AND name = $2`
+		insertStmt = `INSERT INTO message_templates (user_id, name, version, content, created_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, name, version) DO NOTHING`
+	default:
+		return false, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var latest int
+	if err := tx.QueryRow(versionStmt, userID, mt.Name).Scan(&latest); err != nil {
+		return false, err
+	}
+	if update && latest == 0 {
+		return false, errTemplateNotFound
+	} else if !update && latest > 0 {
+		return false, errTemplateExists
+	}
+
+	version, createdAt := latest+1, time.Now()
+	res, err := tx.Exec(insertStmt, userID, mt.Name, version, string(content), createdAt.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	mt.Version, mt.CreatedAt = version, createdAt
+	return true, nil
+}
+
+func scanTemplate(scan func(dest ...interface{}) error) (*messageTemplate, error) {
+	var mt messageTemplate
+	var name, content string
+	var version int
+	var createdAt int64
+	if err := scan(&name, &version, &content, &createdAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(content), &mt); err != nil {
+		return nil, fmt.Errorf("failed to decode template %s: %w", name, err)
+	}
+	mt.Name = name
+	mt.Version = version
+	mt.CreatedAt = time.UnixMilli(createdAt)
+	return &mt, nil
+}
+
+// Gets a version of a template, the latest one when version is zero
+func getTemplate(db *sql.DB, userID int, name string, version int) (*messageTemplate, error) {
+	var row *sql.Row
+	switch dbType {
+	case "sqlite3":
+		row = db.QueryRow(`SELECT name, version, content, created_at FROM message_templates
+			WHERE user_id = ? AND name = ? AND (? = 0 OR version = ?) ORDER BY version DESC LIMIT 1`, userID, name, version, version)
+	case "postgresql":
+		row = db.QueryRow(`SELECT name, version, content, created_at FROM message_templates
+			WHERE user_id = $1 AND name = $2 AND ($3 = 0 OR version = $3) ORDER BY version DESC LIMIT 1`, userID, name, version)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	mt, err := scanTemplate(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTemplateNotFound
+	}
+	return mt, err
+}
+
+func queryTemplates(db *sql.DB, query string, args ...interface{}) ([]messageTemplate, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []messageTemplate{}
+	for rows.Next() {
+		mt, err := scanTemplate(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, *mt)
+	}
+	return templates, rows.Err()
+}
+
+// Returns the latest version of every template of a user by name
+func listTemplates(db *sql.DB, userID int) ([]messageTemplate, error) {
+	switch dbType {
+	case "sqlite3":
+		return queryTemplates(db, `SELECT name, version, content, created_at FROM message_templates t
+			WHERE user_id = ? AND version = (SELECT MAX(version) FROM message_templates WHERE user_id = t.user_id AND name = t.name)
+			ORDER BY name`, userID)
+	case "postgresql":
+		return queryTemplates(db, `SELECT name, version, content, created_at FROM message_templates t
+			WHERE user_id = $1 AND version = (SELECT MAX(version) FROM message_templates WHERE user_id = t.user_id AND name = t.name)
+			ORDER BY name`, userID)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+}
+
+// Returns all versions of a template, newest first
+func listTemplateVersions(db *sql.DB, userID int, name string) ([]messageTemplate, error) {
+	var templates []messageTemplate
+	var err error
+	switch dbType {
+	case "sqlite3":
+		templates, err = queryTemplates(db, `SELECT name, version, content, created_at FROM message_templates
+			WHERE user_id = ? AND name = ? ORDER BY version DESC`, userID, name)
+	case "postgresql":
+		templates, err = queryTemplates(db, `SELECT name, version, content, created_at FROM message_templates
+			WHERE user_id = $1 AND name = $2 ORDER BY version DESC`, userID, name)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err == nil && len(templates) == 0 {
+		return nil, errTemplateNotFound
+	}
+	return templates, err
+}
+
+// Deletes a template with all its versions
+func deleteTemplate(db *sql.DB, userID int, name string) error {
+	var res sql.Result
+	var err error
+	switch dbType {
+	case "sqlite3":
+		res, err = db.Exec(`DELETE FROM message_templates WHERE user_id = ? AND name = ?`, userID, name)
+	case "postgresql":
+		res, err = db.Exec(`DELETE FROM message_templates WHERE user_id = $1 AND name = $2`, userID, name)
+	default:
+		return fmt.Errorf("unsupported database type: %s", dbType)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
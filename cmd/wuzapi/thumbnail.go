@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Longest side in pixels of the JPEG previews embedded in media messages
+const thumbnailSize = 72
+
+// Dimensions and preview of an image
+type imageMeta struct {
+	Width     uint32
+	Height    uint32
+	Thumbnail []byte
+}
+
+// Images above this many pixels are not decoded to build previews
+const maxPreviewPixels = 64 << 20
+
+// Decodes an image and generates its dimensions and JPEG thumbnail
+func getImageMeta(data []byte) (*imageMeta, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPreviewPixels {
+		return nil, fmt.Errorf("image too large for preview (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	thumbnail, err := makeThumbnail(img)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	return &imageMeta{
+		Width:     uint32(bounds.Dx()),
+		Height:    uint32(bounds.Dy()),
+		Thumbnail: thumbnail,
+	}, nil
+}
+
+// Encodes a small JPEG preview of img
+func makeThumbnail(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleToFit(img, thumbnailSize), &jpeg.Options{Quality: 60}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Scales img down so that its longest side is at most size pixels
+func scaleToFit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width > height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Duration and dimensions of an MP4 video
+type videoMeta struct {
+	Seconds uint32
+	Width   uint32
+	Height  uint32
+}
+
+// Reads the duration and dimensions from the moov box of an MP4/3GP file
+func getVideoMeta(data []byte) (*videoMeta, bool) {
+	moov, ok := findBox(data, "moov")
+	if !ok {
+		return nil, false
+	}
+
+	var meta videoMeta
+	if mvhd, ok := findBox(moov, "mvhd"); ok && len(mvhd) >= 4 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 && len(mvhd) >= 32 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+			duration = binary.BigEndian.Uint64(mvhd[24:32])
+		} else if len(mvhd) >= 20 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+		}
+		if timescale > 0 {
+			meta.Seconds = uint32((duration + timescale/2) / timescale)
+		}
+	}
+
+	// The first track with a picture size is the video track
+	for rest := moov; ; {
+		trak, next, ok := nextBox(rest, "trak")
+		if !ok {
+			break
+		}
+		rest = next
+		tkhd, ok := findBox(trak, "tkhd")
+		if !ok || len(tkhd) < 4 {
+			continue
+		}
+		offset := 76
+		if tkhd[0] == 1 {
+			offset = 88
+		}
+		if len(tkhd) < offset+8 {
+			continue
+		}
+		width := binary.BigEndian.Uint32(tkhd[offset:offset+4]) >> 16
+		height := binary.BigEndian.Uint32(tkhd[offset+4:offset+8]) >> 16
+		if width > 0 && height > 0 {
+			meta.Width, meta.Height = width, height
+			break
+		}
+	}
+
+	return &meta, true
+}
+
+// Returns the payload of the first box of the given type in data
+func findBox(data []byte, boxType string) ([]byte, bool) {
+	payload, _, ok := nextBox(data, boxType)
+	return payload, ok
+}
+
+// Returns the payload of the next box of the given type in data, and the data after it
+func nextBox(data []byte, boxType string) ([]byte, []byte, bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, nil, false
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, nil, false
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size], data[size:], true
+		}
+		data = data[size:]
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// Builds an MP4 box with a 32 bit size
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, boxType...), body...)
+}
+
+// Builds an MP4 box with a 64 bit size
+func mp4LargeBox(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, 1)
+	box = append(box, boxType...)
+	box = binary.BigEndian.AppendUint64(box, uint64(16+len(body)))
+	return append(box, body...)
+}
+
+func mvhdV0(timescale, duration uint32) []byte {
+	payload := make([]byte, 100)
+	binary.BigEndian.PutUint32(payload[12:], timescale)
+	binary.BigEndian.PutUint32(payload[16:], duration)
+	return mp4Box("mvhd", payload)
+}
+
+func mvhdV1(timescale uint32, duration uint64) []byte {
+	payload := make([]byte, 112)
+	payload[0] = 1
+	binary.BigEndian.PutUint32(payload[20:], timescale)
+	binary.BigEndian.PutUint64(payload[24:], duration)
+	return mp4Box("mvhd", payload)
+}
+
+func tkhd(version byte, width, height uint32) []byte {
+	offset := 76
+	if version == 1 {
+		offset = 88
+	}
+	payload := make([]byte, offset+8)
+	payload[0] = version
+	binary.BigEndian.PutUint32(payload[offset:], width<<16)
+	binary.BigEndian.PutUint32(payload[offset+4:], height<<16)
+	return mp4Box("tkhd", payload)
+}
+
+func TestGetVideoMeta(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	mdat := mp4Box("mdat", make([]byte, 64))
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+		want videoMeta
+	}{
+		{
+			name: "version 0 boxes",
+			data: bytes.Join([][]byte{ftyp, mdat, mp4Box("moov", mvhdV0(1000, 12400), mp4Box("trak", tkhd(0, 640, 360)))}, nil),
+			ok:   true,
+			want: videoMeta{Seconds: 12, Width: 640, Height: 360},
+		},
+		{
+			name: "version 1 boxes",
+			data: bytes.Join([][]byte{ftyp, mp4Box("moov", mvhdV1(90000, 90000*61+45000), mp4Box("trak", tkhd(1, 1920, 1080)))}, nil),
+			ok:   true,
+			want: videoMeta{Seconds: 62, Width: 1920, Height: 1080},
+		},
+		{
+			name: "audio track before video track",
+			data: mp4Box("moov", mvhdV0(600, 600), mp4Box("trak", tkhd(0, 0, 0)), mp4Box("trak", mp4Box("mdia"), tkhd(0, 480, 854))),
+			ok:   true,
+			want: videoMeta{Seconds: 1, Width: 480, Height: 854},
+		},
+		{
+			name: "64 bit box sizes",
+			data: bytes.Join([][]byte{mp4LargeBox("mdat", make([]byte, 32)), mp4LargeBox("moov", mvhdV0(1, 5), mp4Box("trak", tkhd(0, 320, 240)))}, nil),
+			ok:   true,
+			want: videoMeta{Seconds: 5, Width: 320, Height: 240},
+		},
+		{
+			name: "last box extends to end of file",
+			data: append(ftyp, append([]byte{0, 0, 0, 0, 'm', 'o', 'o', 'v'}, mvhdV0(10, 30)...)...),
+			ok:   true,
+			want: videoMeta{Seconds: 3},
+		},
+		{
+			name: "zero timescale",
+			data: mp4Box("moov", mvhdV0(0, 30), mp4Box("trak", tkhd(0, 2, 2))),
+			ok:   true,
+			want: videoMeta{Width: 2, Height: 2},
+		},
+		{
+			name: "truncated track header",
+			data: mp4Box("moov", mvhdV0(1, 1), mp4Box("trak", mp4Box("tkhd", make([]byte, 40)))),
+			ok:   true,
+			want: videoMeta{Seconds: 1},
+		},
+		{
+			name: "no moov box",
+			data: bytes.Join([][]byte{ftyp, mdat}, nil),
+		},
+		{
+			name: "box size beyond end of data",
+			data: append(binary.BigEndian.AppendUint32(nil, 4096), "moov"...),
+		},
+		{
+			name: "box size smaller than header",
+			data: append(binary.BigEndian.AppendUint32(nil, 4), "moov"...),
+		},
+		{
+			name: "truncated 64 bit size",
+			data: append(binary.BigEndian.AppendUint32(nil, 1), "moov\x00\x00"...),
+		},
+		{
+			name: "not a video",
+			data: []byte("hello world, this is not an MP4 file"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getVideoMeta(tt.data)
+			if ok != tt.ok {
+				t.Fatalf("getVideoMeta() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && *got != tt.want {
+				t.Errorf("getVideoMeta() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		{50, 40, 50, 40},
+		{72, 72, 72, 72},
+		{720, 360, 72, 36},
+		{360, 720, 36, 72},
+		{10000, 10, 72, 1},
+	}
+
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+		bounds := scaleToFit(img, thumbnailSize).Bounds()
+		if bounds.Dx() != tt.wantW || bounds.Dy() != tt.wantH {
+			t.Errorf("scaleToFit(%dx%d) = %dx%d, want %dx%d", tt.width, tt.height, bounds.Dx(), bounds.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestGetImageMeta(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := getImageMeta(buf.Bytes())
+	if err != nil {
+		t.Fatalf("getImageMeta() error = %v", err)
+	}
+	if meta.Width != 300 || meta.Height != 200 {
+		t.Errorf("getImageMeta() size = %dx%d, want 300x200", meta.Width, meta.Height)
+	}
+	thumb, format, err := image.DecodeConfig(bytes.NewReader(meta.Thumbnail))
+	if err != nil || format != "jpeg" || thumb.Width != 72 || thumb.Height != 48 {
+		t.Errorf("thumbnail = %s %dx%d (%v), want jpeg 72x48", format, thumb.Width, thumb.Height, err)
+	}
+
+	if _, err := getImageMeta([]byte("not an image")); err == nil {
+		t.Error("getImageMeta() accepted invalid data")
+	}
+}
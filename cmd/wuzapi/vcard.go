@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Phone number of a contact. Type is the vCard type, such as CELL, HOME or
+// WORK, or a custom label. WaId is the WhatsApp number the phone belongs to,
+// which WhatsApp uses to offer messaging the contact.
+type contactPhone struct {
+	Number string
+	Type   string `json:",omitempty"`
+	WaId   string `json:",omitempty"`
+}
+
+// Email address of a contact. Type is the vCard type, such as HOME or WORK.
+type contactEmail struct {
+	Address string
+	Type    string `json:",omitempty"`
+}
+
+// Contact card, rendered to or parsed from a vCard
+type contactCard struct {
+	Name         string
+	Organization string         `json:",omitempty"`
+	Phones       []contactPhone `json:",omitempty"`
+	Emails       []contactEmail `json:",omitempty"`
+	Url          string         `json:",omitempty"`
+}
+
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+// URI values are not text and must not be escaped, only kept on one line
+var vcardURIStripper = strings.NewReplacer("\r", "", "\n", "")
+
+// Checks a contact has what is needed to render it
+func (c *contactCard) validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("missing Name in contact")
+	}
+	if len(c.Phones) == 0 && len(c.Emails) == 0 {
+		return fmt.Errorf("contact %s has no Phones or Emails", c.Name)
+	}
+	for _, phone := range c.Phones {
+		if phone.Number == "" {
+			return fmt.Errorf("missing Number in phone of contact %s", c.Name)
+		}
+		if phone.WaId == "" && onlyDigits(phone.Number) == "" {
+			return fmt.Errorf("invalid Number %s in contact %s", phone.Number, c.Name)
+		}
+	}
+	for _, email := range c.Emails {
+		if email.Address == "" {
+			return fmt.Errorf("missing Address in email of contact %s", c.Name)
+		}
+	}
+	return nil
+}
+
+// Renders the contact as a vCard 3.0. Phones carry the waid parameter, taken
+// from the number unless given.
+func (c *contactCard) vcard() string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCARD")
+	line("VERSION:3.0")
+	line("N:;%s;;;", vcardEscaper.Replace(c.Name))
+	line("FN:%s", vcardEscaper.Replace(c.Name))
+	if c.Organization != "" {
+		line("ORG:%s;", vcardEscaper.Replace(c.Organization))
+	}
+	for _, phone := range c.Phones {
+		waid := phone.WaId
+		if waid == "" {
+			waid = onlyDigits(phone.Number)
+		}
+		line("TEL;type=%s;waid=%s:%s", vcardType(phone.Type, "CELL"), onlyDigits(waid), vcardEscaper.Replace(phone.Number))
+	}
+	for _, email := range c.Emails {
+		line("EMAIL;type=INTERNET;type=%s:%s", vcardType(email.Type, "HOME"), vcardEscaper.Replace(email.Address))
+	}
+	if c.Url != "" {
+		line("URL:%s", vcardURIStripper.Replace(c.Url))
+	}
+	line("END:VCARD")
+	return b.String()
+}
+
+// Builds the message carrying the given contacts, a single contact message
+// or a contacts array for several
+func buildContactsMessage(contacts []*waProto.ContactMessage, displayName string) *waProto.Message {
+	if len(contacts) == 1 {
+		return &waProto.Message{ContactMessage: contacts[0]}
+	}
+	if displayName == "" {
+		displayName = fmt.Sprintf("%s and %d other contacts", contacts[0].GetDisplayName(), len(contacts)-1)
+	}
+	return &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+		DisplayName: &displayName,
+		Contacts:    contacts,
+	}}
+}
+
+// Parses the contacts of an incoming contact or contacts array message
+func messageContacts(msg *waProto.Message) []contactCard {
+	var contacts []*waProto.ContactMessage
+	if contact := msg.GetContactMessage(); contact != nil {
+		contacts = append(contacts, contact)
+	}
+	contacts = append(contacts, msg.GetContactsArrayMessage().GetContacts()...)
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	cards := make([]contactCard, 0, len(contacts))
+	for _, contact := range contacts {
+		card := parseVcard(contact.GetVcard())
+		if card.Name == "" {
+			card.Name = contact.GetDisplayName()
+		}
+		cards = append(cards, card)
+	}
+	return cards
+}
+
+// Reads the fields of a contactCard from a vCard. Unknown properties are
+// ignored, as are any cards after the first one.
+func parseVcard(vcard string) contactCard {
+	var card contactCard
+	var structuredName string
+
+	// Properties can be grouped, with custom labels for them set through the
+	// X-ABLabel property of the group
+	labels := map[string]string{}
+	phoneGroups := map[int]string{}
+	emailGroups := map[int]string{}
+
+	for _, line := range unfoldVcard(vcard) {
+		colon := vcardColon(line)
+		if colon < 0 {
+			continue
+		}
+		params := strings.Split(line[:colon], ";")
+		value := line[colon+1:]
+
+		group, name := "", strings.ToUpper(params[0])
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			group, name = name[:dot], name[dot+1:]
+		}
+
+		if name == "END" {
+			break
+		}
+
+		switch name {
+		case "FN":
+			card.Name = unescapeVcard(value)
+		case "N":
+			parts := splitVcard(value)
+			var names []string
+			for _, i := range []int{3, 1, 2, 0, 4} {
+				if i < len(parts) && parts[i] != "" {
+					names = append(names, parts[i])
+				}
+			}
+			structuredName = strings.Join(names, " ")
+		case "ORG":
+			card.Organization = strings.TrimSpace(strings.Join(splitVcard(value), " "))
+		case "URL":
+			if card.Url == "" {
+				card.Url = unescapeVcard(value)
+			}
+		case "TEL":
+			phone := contactPhone{Number: unescapeVcard(value), Type: vcardTypes(params[1:], "VOICE", "PREF")}
+			for _, param := range params[1:] {
+				if key, val, ok := strings.Cut(param, "="); ok && strings.EqualFold(key, "waid") {
+					phone.WaId = val
+				}
+			}
+			if group != "" {
+				phoneGroups[len(card.Phones)] = group
+			}
+			card.Phones = append(card.Phones, phone)
+		case "EMAIL":
+			email := contactEmail{Address: unescapeVcard(value), Type: vcardTypes(params[1:], "INTERNET", "PREF")}
+			if group != "" {
+				emailGroups[len(card.Emails)] = group
+			}
+			card.Emails = append(card.Emails, email)
+		case "X-ABLABEL":
+			if group != "" {
+				labels[group] = unescapeVcard(value)
+			}
+		}
+	}
+
+	if card.Name == "" {
+		card.Name = structuredName
+	}
+	for i, group := range phoneGroups {
+		if label := labels[group]; label != "" && card.Phones[i].Type == "" {
+			card.Phones[i].Type = label
+		}
+	}
+	for i, group := range emailGroups {
+		if label := labels[group]; label != "" && card.Emails[i].Type == "" {
+			card.Emails[i].Type = label
+		}
+	}
+	return card
+}
+
+// Splits a vCard into its logical lines, joining folded ones
+func unfoldVcard(vcard string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(vcard, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Returns the position of the colon separating the name and parameters of a
+// vCard line from its value, skipping colons in quoted parameters
+func vcardColon(line string) int {
+	quoted := false
+	for i, r := range line {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Joins the types of a property, leaving out the generic ones
+func vcardTypes(params []string, ignore ...string) string {
+	var types []string
+	for _, param := range params {
+		key, val, ok := strings.Cut(param, "=")
+		if !ok {
+			// vCard 2.1 lists types without a name
+			val = key
+		} else if !strings.EqualFold(key, "type") {
+			continue
+		}
+		for _, t := range strings.Split(strings.Trim(val, `"`), ",") {
+			t = strings.ToUpper(strings.TrimSpace(t))
+			if t == "" || containsFold(ignore, t) || containsFold(types, t) {
+				continue
+			}
+			types = append(types, t)
+		}
+	}
+	return strings.Join(types, ",")
+}
+
+// Returns the type to render for a property, given the requested one
+func vcardType(t string, fallback string) string {
+	t = strings.TrimSpace(t)
+	if t == "" {
+		return fallback
+	}
+	return strings.Map(func(r rune) rune {
+		if r == ';' || r == ':' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(t))
+}
+
+// Splits a structured vCard value on unescaped semicolons, unescaping the parts
+func splitVcard(value string) []string {
+	var parts []string
+	var part strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			part.WriteRune('\\')
+			part.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			parts = append(parts, unescapeVcard(part.String()))
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, unescapeVcard(part.String()))
+}
+
+func unescapeVcard(value string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range value {
+		if escaped {
+			if r == 'n' || r == 'N' {
+				b.WriteRune('\n')
+			} else {
+				b.WriteRune(r)
+			}
+			escaped = false
+		} else if r == '\\' {
+			escaped = true
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func onlyDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"math/bits"
+	"sort"
+)
+
+// Minimal lossless WebP (VP8L) encoder. It applies the subtract green
+// transform and LZ77 backward references to the previous pixel and to the
+// pixel above, which is enough to keep stickers with flat areas and
+// transparent padding small, without depending on libwebp.
+
+const (
+	vp8lSignature       = 0x2f
+	vp8lMaxLength       = 4096
+	vp8lGreenAlphabet   = 256 + 24
+	vp8lDistAlphabet    = 40
+	vp8lMaxCodeLength   = 15
+	vp8lMaxCLCodeLength = 7
+)
+
+// Order in which code length code lengths are stored
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Writes bits least significant first, as the VP8L bitstream expects
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) write(value uint32, n uint) {
+	w.acc |= uint64(value) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.n = 0, 0
+	}
+	return w.buf
+}
+
+// A literal pixel, or a backward reference when length is non zero
+type vp8lToken struct {
+	argb     uint32
+	length   int
+	distCode int
+}
+
+// Encodes img as a lossless VP8L bitstream, without the RIFF container
+func encodeVP8L(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return nil, errors.New("invalid image size for webp")
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	pixels := make([]uint32, width*height)
+	hasAlpha := false
+	for i := range pixels {
+		p := nrgba.Pix[i*4 : i*4+4]
+		r, g, b, a := uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		if a != 0xff {
+			hasAlpha = true
+		}
+		// Subtract green transform
+		r = (r - g) & 0xff
+		b = (b - g) & 0xff
+		pixels[i] = a<<24 | r<<16 | g<<8 | b
+	}
+
+	tokens := vp8lBackwardRefs(pixels, width)
+
+	var green [vp8lGreenAlphabet]int
+	var red, blue, alpha [256]int
+	var dist [vp8lDistAlphabet]int
+	for _, t := range tokens {
+		if t.length > 0 {
+			prefix, _, _ := vp8lPrefixEncode(t.length)
+			green[256+prefix]++
+			prefix, _, _ = vp8lPrefixEncode(t.distCode)
+			dist[prefix]++
+			continue
+		}
+		green[(t.argb>>8)&0xff]++
+		red[(t.argb>>16)&0xff]++
+		blue[t.argb&0xff]++
+		alpha[t.argb>>24]++
+	}
+
+	w := &bitWriter{}
+	w.write(vp8lSignature, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if hasAlpha {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(0, 3) // version
+
+	w.write(1, 1) // transform present
+	w.write(2, 2) // subtract green
+	w.write(0, 1) // no more transforms
+	w.write(0, 1) // no color cache
+	w.write(0, 1) // no meta prefix codes
+
+	greenLengths := writeHuffmanCode(w, green[:])
+	redLengths := writeHuffmanCode(w, red[:])
+	blueLengths := writeHuffmanCode(w, blue[:])
+	alphaLengths := writeHuffmanCode(w, alpha[:])
+	distLengths := writeHuffmanCode(w, dist[:])
+
+	greenCodes := canonicalCodes(greenLengths)
+	redCodes := canonicalCodes(redLengths)
+	blueCodes := canonicalCodes(blueLengths)
+	alphaCodes := canonicalCodes(alphaLengths)
+	distCodes := canonicalCodes(distLengths)
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			prefix, extraBits, extra := vp8lPrefixEncode(t.length)
+			w.write(greenCodes[256+prefix], uint(greenLengths[256+prefix]))
+			w.write(extra, extraBits)
+			prefix, extraBits, extra = vp8lPrefixEncode(t.distCode)
+			w.write(distCodes[prefix], uint(distLengths[prefix]))
+			w.write(extra, extraBits)
+			continue
+		}
+		g := (t.argb >> 8) & 0xff
+		r := (t.argb >> 16) & 0xff
+		b := t.argb & 0xff
+		a := t.argb >> 24
+		w.write(greenCodes[g], uint(greenLengths[g]))
+		w.write(redCodes[r], uint(redLengths[r]))
+		w.write(blueCodes[b], uint(blueLengths[b]))
+		w.write(alphaCodes[a], uint(alphaLengths[a]))
+	}
+
+	return w.bytes(), nil
+}
+
+// Splits pixels in literals and copies of the previous pixel or the pixel above
+func vp8lBackwardRefs(pixels []uint32, width int) []vp8lToken {
+	var tokens []vp8lToken
+	matchLength := func(i, dist int) int {
+		n := 0
+		for i+n < len(pixels) && n < vp8lMaxLength && pixels[i+n] == pixels[i+n-dist] {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(pixels); {
+		left, up := 0, 0
+		if i >= 1 {
+			left = matchLength(i, 1)
+		}
+		if i >= width {
+			up = matchLength(i, width)
+		}
+		switch {
+		case up >= left && up >= 3:
+			// Distance code 1 is the (0,1) neighbour, the pixel above
+			tokens = append(tokens, vp8lToken{length: up, distCode: 1})
+			i += up
+		case left >= 3:
+			// Distance code 2 is the (1,0) neighbour, the previous pixel
+			tokens = append(tokens, vp8lToken{length: left, distCode: 2})
+			i += left
+		default:
+			tokens = append(tokens, vp8lToken{argb: pixels[i]})
+			i++
+		}
+	}
+	return tokens
+}
+
+// Splits a length or distance code into its prefix symbol and extra bits
+func vp8lPrefixEncode(value int) (int, uint, uint32) {
+	if value <= 4 {
+		return value - 1, 0, 0
+	}
+	value--
+	highest := bits.Len(uint(value)) - 1
+	second := (value >> (highest - 1)) & 1
+	extraBits := highest - 1
+	extra := value & (1<<extraBits - 1)
+	return 2*highest + second, uint(extraBits), uint32(extra)
+}
+
+// Writes a normal prefix code for the symbol frequencies and returns its code lengths
+func writeHuffmanCode(w *bitWriter, freqs []int) []uint8 {
+	lengths := huffmanLengths(freqs, vp8lMaxCodeLength)
+
+	type clToken struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []clToken
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, clToken{symbol: int(lengths[i])})
+			i++
+			continue
+		}
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		for run > 0 {
+			switch {
+			case run >= 11:
+				n := min(run, 138)
+				tokens = append(tokens, clToken{symbol: 18, extra: uint32(n - 11), extraBits: 7})
+				run -= n
+			case run >= 3:
+				tokens = append(tokens, clToken{symbol: 17, extra: uint32(run - 3), extraBits: 3})
+				run = 0
+			default:
+				tokens = append(tokens, clToken{symbol: 0})
+				run--
+			}
+		}
+	}
+
+	clFreqs := make([]int, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		clFreqs[t.symbol]++
+	}
+	clLengths := huffmanLengths(clFreqs, vp8lMaxCLCodeLength)
+	clCodes := canonicalCodes(clLengths)
+
+	count := len(vp8lCodeLengthOrder)
+	for count > 4 && clLengths[vp8lCodeLengthOrder[count-1]] == 0 {
+		count--
+	}
+
+	w.write(0, 1) // normal code
+	w.write(uint32(count-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:count] {
+		w.write(uint32(clLengths[symbol]), 3)
+	}
+	w.write(0, 1) // code lengths cover the whole alphabet
+	for _, t := range tokens {
+		w.write(clCodes[t.symbol], uint(clLengths[t.symbol]))
+		if t.extraBits > 0 {
+			w.write(t.extra, t.extraBits)
+		}
+	}
+	return lengths
+}
+
+// Computes Huffman code lengths no longer than maxBits. At least two symbols
+// always get a code, so the result is a complete prefix code.
+func huffmanLengths(freqs []int, maxBits int) []uint8 {
+	f := make([]int, len(freqs))
+	copy(f, freqs)
+	used := 0
+	for _, v := range f {
+		if v > 0 {
+			used++
+		}
+	}
+	for i := 0; used < 2 && i < len(f); i++ {
+		if f[i] == 0 {
+			f[i] = 1
+			used++
+		}
+	}
+
+	for {
+		lengths := huffmanTreeDepths(f)
+		longest := uint8(0)
+		for _, l := range lengths {
+			longest = max(longest, l)
+		}
+		if int(longest) <= maxBits {
+			return lengths
+		}
+		// Flatten the distribution until the tree is shallow enough
+		for i, v := range f {
+			if v > 0 {
+				f[i] = (v >> 1) | 1
+			}
+		}
+	}
+}
+
+// Builds a Huffman tree and returns the depth of each used symbol
+func huffmanTreeDepths(freqs []int) []uint8 {
+	type node struct {
+		freq   int
+		parent int
+	}
+	var nodes []node
+	var symbols []int
+	for symbol, f := range freqs {
+		if f > 0 {
+			nodes = append(nodes, node{freq: f, parent: -1})
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	// Two queue construction: leaves sorted by frequency, then internal
+	// nodes which are created in non decreasing frequency order
+	leaves := make([]int, len(nodes))
+	for i := range leaves {
+		leaves[i] = i
+	}
+	sort.SliceStable(leaves, func(a, b int) bool { return nodes[leaves[a]].freq < nodes[leaves[b]].freq })
+	var internal []int
+	li, ii := 0, 0
+	pop := func() int {
+		if li < len(leaves) && (ii >= len(internal) || nodes[leaves[li]].freq <= nodes[internal[ii]].freq) {
+			li++
+			return leaves[li-1]
+		}
+		ii++
+		return internal[ii-1]
+	}
+	for remaining := len(leaves); remaining > 1; remaining-- {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+		parent := len(nodes) - 1
+		nodes[a].parent = parent
+		nodes[b].parent = parent
+		internal = append(internal, parent)
+	}
+
+	lengths := make([]uint8, len(freqs))
+	for i, symbol := range symbols {
+		depth := uint8(0)
+		for n := i; nodes[n].parent >= 0; n = nodes[n].parent {
+			depth++
+		}
+		lengths[symbol] = depth
+	}
+	return lengths
+}
+
+// Returns canonical prefix codes for the code lengths, bit reversed so they
+// can be written least significant bit first
+func canonicalCodes(lengths []uint8) []uint32 {
+	var count [vp8lMaxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [vp8lMaxCodeLength + 2]uint32
+	code := uint32(0)
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[symbol] = bits.Reverse32(next[l]) >> (32 - uint(l))
+		next[l]++
+	}
+	return codes
+}
+
+// A chunk of a RIFF/WebP file
+type riffChunk struct {
+	ID   string
+	Data []byte
+}
+
+// Splits a WebP file in its chunks
+func parseWebPChunks(data []byte) ([]riffChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp file")
+	}
+	var chunks []riffChunk
+	rest := data[12:]
+	for len(rest) >= 8 {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		if size < 0 || size > len(rest)-8 {
+			return nil, errors.New("corrupt webp chunk")
+		}
+		chunks = append(chunks, riffChunk{ID: string(rest[0:4]), Data: rest[8 : 8+size]})
+		rest = rest[8+size:]
+		if size%2 == 1 && len(rest) > 0 {
+			rest = rest[1:]
+		}
+	}
+	return chunks, nil
+}
+
+// Serializes chunks in a WebP RIFF container
+func buildWebP(chunks []riffChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, c := range chunks {
+		body.WriteString(c.ID)
+		_ = binary.Write(&body, binary.LittleEndian, uint32(len(c.Data)))
+		body.Write(c.Data)
+		if len(c.Data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	_ = binary.Write(&out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// VP8X feature flags
+const (
+	vp8xFlagAnimation = 0x02
+	vp8xFlagEXIF      = 0x08
+	vp8xFlagAlpha     = 0x10
+)
+
+// Builds a VP8X chunk payload for a canvas of the given size
+func vp8xChunk(flags byte, width, height int) riffChunk {
+	data := make([]byte, 10)
+	data[0] = flags
+	putUint24(data[4:7], uint32(width-1))
+	putUint24(data[7:10], uint32(height-1))
+	return riffChunk{ID: "VP8X", Data: data}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeVP8L(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fill := func(width, height int, pixel func(x, y int) color.NRGBA) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetNRGBA(x, y, pixel(x, y))
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"single pixel", fill(1, 1, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} })},
+		{"solid color", fill(64, 64, func(x, y int) color.NRGBA { return color.NRGBA{200, 30, 90, 255} })},
+		{"transparent padding", fill(100, 40, func(x, y int) color.NRGBA {
+			if x < 20 || x >= 80 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{0, 128, 255, 200}
+		})},
+		{"vertical stripes", fill(37, 23, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x * 7), uint8(x * 3), 0, 255} })},
+		{"gradient", fill(300, 5, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x), uint8(y * 50), uint8(x + y), uint8(255 - x/2)}
+		})},
+		{"run longer than maximum copy length", fill(5000, 2, func(x, y int) color.NRGBA { return color.NRGBA{1, 2, 3, 255} })},
+		{"noise", fill(128, 128, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))}
+		})},
+		{"skewed noise", fill(200, 200, func(x, y int) color.NRGBA {
+			// Very uneven symbol frequencies need code lengths above the limit
+			v := uint8(0)
+			if rng.Intn(2) == 0 {
+				v = uint8(rng.Intn(256))
+			}
+			return color.NRGBA{v, uint8(rng.ExpFloat64() * 4), v, 255}
+		})},
+		{"non zero bounds", image.NewNRGBA(image.Rect(10, 10, 20, 30))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bitstream, err := encodeVP8L(tt.img)
+			if err != nil {
+				t.Fatalf("encodeVP8L() error = %v", err)
+			}
+			decoded, err := webp.Decode(bytes.NewReader(buildWebP([]riffChunk{{ID: "VP8L", Data: bitstream}})))
+			if err != nil {
+				t.Fatalf("decoding encoded image: %v", err)
+			}
+
+			bounds := tt.img.Bounds()
+			if decoded.Bounds().Dx() != bounds.Dx() || decoded.Bounds().Dy() != bounds.Dy() {
+				t.Fatalf("decoded size = %v, want %v", decoded.Bounds().Size(), bounds.Size())
+			}
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					want := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+					if got != want {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeVP8LInvalidSize(t *testing.T) {
+	for _, rect := range []image.Rectangle{image.Rect(0, 0, 0, 10), image.Rect(0, 0, 1<<14+1, 1)} {
+		if _, err := encodeVP8L(image.NewNRGBA(rect)); err == nil {
+			t.Errorf("encodeVP8L(%v) accepted invalid size", rect)
+		}
+	}
+}
+
+func TestVP8LPrefixEncode(t *testing.T) {
+	tests := []struct {
+		value     int
+		prefix    int
+		extraBits uint
+		extra     uint32
+	}{
+		{1, 0, 0, 0},
+		{4, 3, 0, 0},
+		{5, 4, 1, 0},
+		{6, 4, 1, 1},
+		{7, 5, 1, 0},
+		{9, 6, 2, 0},
+		{12, 6, 2, 3},
+		{13, 7, 2, 0},
+		{4096, 23, 10, 1023},
+	}
+
+	for _, tt := range tests {
+		prefix, extraBits, extra := vp8lPrefixEncode(tt.value)
+		if prefix != tt.prefix || extraBits != tt.extraBits || extra != tt.extra {
+			t.Errorf("vp8lPrefixEncode(%d) = %d, %d, %d, want %d, %d, %d", tt.value, prefix, extraBits, extra, tt.prefix, tt.extraBits, tt.extra)
+		}
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	fibonacci := make([]int, 30)
+	fibonacci[0], fibonacci[1] = 1, 1
+	for i := 2; i < len(fibonacci); i++ {
+		fibonacci[i] = fibonacci[i-1] + fibonacci[i-2]
+	}
+
+	tests := []struct {
+		name    string
+		freqs   []int
+		maxBits int
+	}{
+		{"no symbols", make([]int, 10), 15},
+		{"one symbol", []int{0, 0, 5, 0}, 15},
+		{"uniform", []int{3, 3, 3, 3, 3, 3, 3, 3}, 15},
+		{"skewed beyond limit", fibonacci, 15},
+		{"code length code limit", fibonacci[:19], 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lengths := huffmanLengths(tt.freqs, tt.maxBits)
+			used := 0
+			kraft := 0.0
+			for symbol, l := range lengths {
+				if int(l) > tt.maxBits {
+					t.Errorf("symbol %d has length %d, above %d", symbol, l, tt.maxBits)
+				}
+				if tt.freqs[symbol] > 0 && l == 0 {
+					t.Errorf("used symbol %d has no code", symbol)
+				}
+				if l > 0 {
+					used++
+					kraft += 1 / float64(uint(1)<<l)
+				}
+			}
+			if used < 2 || kraft != 1 {
+				t.Errorf("lengths %v are not a complete prefix code", lengths)
+			}
+		})
+	}
+}
+
+func TestCanonicalCodes(t *testing.T) {
+	// Lengths from the DEFLATE specification example, codes written bit reversed
+	lengths := []uint8{3, 3, 3, 3, 3, 2, 4, 4}
+	want := []uint32{0b010, 0b110, 0b001, 0b101, 0b011, 0b00, 0b0111, 0b1111}
+	got := canonicalCodes(lengths)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("canonicalCodes() symbol %d = %b, want %b", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWebPChunks(t *testing.T) {
+	chunks := []riffChunk{
+		vp8xChunk(vp8xFlagAlpha|vp8xFlagEXIF, 512, 300),
+		{ID: "VP8L", Data: []byte{1, 2, 3}},
+		{ID: "EXIF", Data: []byte{4, 5, 6, 7}},
+	}
+	data := buildWebP(chunks)
+	if len(data)%2 != 0 {
+		t.Errorf("buildWebP() produced odd length %d", len(data))
+	}
+
+	parsed, err := parseWebPChunks(data)
+	if err != nil {
+		t.Fatalf("parseWebPChunks() error = %v", err)
+	}
+	if len(parsed) != len(chunks) {
+		t.Fatalf("parseWebPChunks() returned %d chunks, want %d", len(parsed), len(chunks))
+	}
+	for i := range chunks {
+		if parsed[i].ID != chunks[i].ID || !bytes.Equal(parsed[i].Data, chunks[i].Data) {
+			t.Errorf("chunk %d = %s %v, want %s %v", i, parsed[i].ID, parsed[i].Data, chunks[i].ID, chunks[i].Data)
+		}
+	}
+	vp8x := parsed[0].Data
+	if vp8x[0] != vp8xFlagAlpha|vp8xFlagEXIF || uint24(vp8x[4:7])+1 != 512 || uint24(vp8x[7:10])+1 != 300 {
+		t.Errorf("VP8X chunk = %v", vp8x)
+	}
+
+	for name, bad := range map[string][]byte{
+		"not riff":          []byte("GIF89a......"),
+		"chunk beyond file": append([]byte("RIFF\x00\x00\x00\x00WEBPVP8L"), 0xff, 0, 0, 0, 1),
+	} {
+		if _, err := parseWebPChunks(bad); err == nil {
+			t.Errorf("parseWebPChunks(%s) accepted invalid data", name)
+		}
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -36,7 +35,6 @@ import (
 // var wlog waLog.Logger
 var clientPointer = make(map[int]*whatsmeow.Client)
 var clientHttp = make(map[int]*resty.Client)
-var historySyncID int32
 
 type MyClient struct {
 	WAClient       *whatsmeow.Client
@@ -45,6 +43,7 @@ type MyClient struct {
 	token          string
 	subscriptions  []string
 	db             *sql.DB
+	sendGate       *sendGate
 }
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
@@ -230,7 +229,7 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		client = whatsmeow.NewClient(deviceStore, nil)
 	}
 	clientPointer[userID] = client
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
+	mycli := MyClient{client, 1, userID, token, subscriptions, s.db, &sendGate{}}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
 
 	// Initialize the HTTP client
@@ -367,11 +366,18 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		}
 	}
 
+	// Send queued, scheduled and broadcast messages while the session lives
+	queueStop := make(chan struct{})
+	go s.runSendQueue(&mycli, queueStop)
+	go s.runScheduler(&mycli, queueStop)
+	go s.runBroadcasts(&mycli, queueStop)
+
 	// Keep connected client live until disconnected/killed
 	for {
 		select {
 		case <-killchannel[userID]:
 			log.Info().Str("userid", strconv.Itoa(userID)).Msg("Received kill signal")
+			close(queueStop)
 
 			// Disconnect the client
 			client.Disconnect()
@@ -421,8 +427,11 @@ func downloadAndSaveMedia(mycli *MyClient, evt *events.Message, mediaType string
 		return "", fmt.Errorf("failed to download %s: %w", mediaType, err)
 	}
 
-	exts, _ := mime.ExtensionsByType(getMimeType())
-	path := filepath.Join(userDirectory, evt.Info.ID+exts[0])
+	ext := ""
+	if exts, _ := mime.ExtensionsByType(getMimeType()); len(exts) > 0 {
+		ext = exts[0]
+	}
+	path := filepath.Join(userDirectory, evt.Info.ID+ext)
 
 	if err := os.WriteFile(path, data, 0600); err != nil {
 		return "", fmt.Errorf("failed to save %s: %w", mediaType, err)
@@ -431,8 +440,118 @@ func downloadAndSaveMedia(mycli *MyClient, evt *events.Message, mediaType string
 	return path, nil
 }
 
+// Turns incoming edits and revokes into MessageEdit and MessageRevoke
+// webhooks, with the original message attached when it is in the index.
+// Returns false for other protocol messages.
+func (mycli *MyClient) handleProtocolMessage(evt *events.Message, protocolMsg *waProto.ProtocolMessage, postmap map[string]interface{}) bool {
+	targetID := protocolMsg.GetKey().GetId()
+	postmap["messageId"] = targetID
+	stored := messageStoreEnabled(mycli.db, mycli.userID)
+
+	switch protocolMsg.GetType() {
+	case waProto.ProtocolMessage_MESSAGE_EDIT, waProto.ProtocolMessage_REVOKE:
+		if !stored {
+			break
+		}
+		if err := storeProtocolMessage(mycli.db, mycli.userID, evt.Info.Chat, protocolMsg); err != nil {
+			log.Error().Err(err).Str("id", targetID).Msg("Failed to update stored message")
+		}
+	}
+
+	switch protocolMsg.GetType() {
+	case waProto.ProtocolMessage_MESSAGE_EDIT:
+		postmap["type"] = "MessageEdit"
+		postmap["text"] = messageText(protocolMsg.GetEditedMessage())
+		original, err := indexEdit(mycli.db, mycli.userID, evt.Info.Chat, protocolMsg, stored)
+		if err == nil {
+			postmap["originalMessage"] = original.Message
+		} else if !errors.Is(err, errMessageNotIndexed) {
+			log.Error().Err(err).Str("id", targetID).Msg("Failed to index edited message")
+		}
+		log.Info().Str("id", targetID).Str("source", evt.Info.SourceString()).Msg("Message edited")
+	case waProto.ProtocolMessage_REVOKE:
+		postmap["type"] = "MessageRevoke"
+		original, err := getIndexedMessage(mycli.db, mycli.userID, evt.Info.Chat.String(), targetID)
+		if err == nil {
+			postmap["originalMessage"] = original.Message
+		} else if !errors.Is(err, errMessageNotIndexed) {
+			log.Error().Err(err).Str("id", targetID).Msg("Failed to look up revoked message")
+		}
+		log.Info().Str("id", targetID).Str("source", evt.Info.SourceString()).Msg("Message revoked")
+	case waProto.ProtocolMessage_EPHEMERAL_SETTING:
+		mycli.updateDisappearingTimer(evt.Info.Chat, protocolMsg.GetEphemeralExpiration())
+		delete(postmap, "messageId")
+		return false
+	default:
+		delete(postmap, "messageId")
+		return false
+	}
+	return true
+}
+
+// Records a disappearing timer change seen in a chat
+func (mycli *MyClient) updateDisappearingTimer(chat types.JID, seconds uint32) {
+	current, err := getDisappearingTimer(mycli.db, mycli.userID, chat)
+	if err == nil && current == seconds {
+		return
+	}
+	if err := saveDisappearingTimer(mycli.db, mycli.userID, chat, seconds); err != nil {
+		log.Error().Err(err).Str("chat", chat.String()).Msg("Failed to save disappearing timer")
+		return
+	}
+	log.Info().Str("chat", chat.String()).Uint32("seconds", seconds).Msg("Disappearing timer changed")
+}
+
+// Decrypts an incoming poll vote, records it and fills the PollVote webhook
+// with the names of the selected options. Returns false if the vote could
+// not be decrypted.
+func (mycli *MyClient) handlePollVote(evt *events.Message, postmap map[string]interface{}) bool {
+	pollID := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetId()
+	vote, err := mycli.WAClient.DecryptPollVote(evt)
+	if err != nil {
+		log.Error().Err(err).Str("id", pollID).Msg("Failed to decrypt poll vote")
+		return false
+	}
+
+	postmap["type"] = "PollVote"
+	postmap["pollId"] = pollID
+	postmap["voter"] = evt.Info.Sender.ToNonAD().String()
+	postmap["selectedOptions"] = []string{}
+
+	indexed, err := getIndexedMessage(mycli.db, mycli.userID, evt.Info.Chat.String(), pollID)
+	if err != nil {
+		log.Warn().Err(err).Str("id", pollID).Msg("Received vote for unknown poll")
+		return true
+	}
+	poll := getPollCreation(indexed.Message)
+	if poll == nil {
+		log.Warn().Str("id", pollID).Msg("Received vote for a message that is not a poll")
+		return true
+	}
+
+	options := pollOptionNames(poll, vote.GetSelectedOptions())
+	postmap["question"] = poll.GetName()
+	postmap["selectedOptions"] = options
+	if err := savePollVote(mycli.db, mycli.userID, evt.Info.Chat, pollID, evt.Info.Sender, options, evt.Info.Timestamp); err != nil {
+		log.Error().Err(err).Str("id", pollID).Msg("Failed to save poll vote")
+	}
+	log.Info().Str("id", pollID).Str("source", evt.Info.SourceString()).Strs("options", options).Msg("Poll vote received")
+	return true
+}
+
+// Fills the LocationUpdate webhook with the position of a live location
+func (mycli *MyClient) handleLocationUpdate(evt *events.Message, update map[string]interface{}, postmap map[string]interface{}) {
+	postmap["type"] = "LocationUpdate"
+	postmap["messageId"] = evt.Info.ID
+	postmap["sender"] = evt.Info.Sender.ToNonAD().String()
+	postmap["chat"] = evt.Info.Chat.String()
+	for key, value := range update {
+		postmap[key] = value
+	}
+	log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Interface("sequence", update["sequenceNumber"]).Msg("Location update received")
+}
+
 func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
-	txtid := strconv.Itoa(mycli.userID)
 	postmap := make(map[string]interface{})
 	postmap["event"] = rawEvt
 	dowebhook := 0
@@ -533,6 +652,36 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Message:
 		postmap["type"] = "Message"
 		dowebhook = 1
+
+		// View once voice notes use a container whatsmeow does not unwrap
+		if inner := evt.Message.GetViewOnceMessageV2Extension().GetMessage(); inner != nil {
+			evt.Message = inner
+			evt.IsViewOnce = true
+		}
+		if evt.IsViewOnce {
+			postmap["isViewOnce"] = true
+		}
+
+		if protocolMsg := evt.Message.GetProtocolMessage(); protocolMsg != nil {
+			if mycli.handleProtocolMessage(evt, protocolMsg, postmap) {
+				break
+			}
+		}
+
+		if evt.Message.GetPollUpdateMessage() != nil {
+			if !mycli.handlePollVote(evt, postmap) {
+				return
+			}
+			break
+		}
+
+		// Live locations are sent again on every move, so their updates are
+		// posted on their own and kept out of the index
+		if update := locationUpdate(evt.Message); update != nil {
+			mycli.handleLocationUpdate(evt, update, postmap)
+			break
+		}
+
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
 			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
@@ -543,12 +692,39 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		if evt.IsViewOnce {
 			metaParts = append(metaParts, "view once")
 		}
-		if evt.IsViewOnce {
+		if evt.IsEphemeral {
 			metaParts = append(metaParts, "ephemeral")
 		}
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
+		// Reactions and the protocol messages passed through above have no
+		// content: they are not indexed and neither count as unread nor
+		// become the last message of the chat
+		if evt.Message.GetReactionMessage() == nil && evt.Message.GetProtocolMessage() == nil {
+			stored := messageStoreEnabled(mycli.db, mycli.userID)
+			if err := indexMessage(mycli.db, mycli.userID, &evt.Info, evt.Message, stored); err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to index message")
+			}
+			if stored {
+				if _, err := storeMessage(mycli.db, mycli.userID, &evt.Info, evt.Message); err != nil {
+					log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to store message")
+				}
+			}
+			if err := touchChat(mycli.db, mycli.userID, evt.Info.Chat, evt.Info.Timestamp, evt.Info.IsFromMe); err != nil {
+				log.Error().Err(err).Str("chat", evt.Info.Chat.String()).Msg("Failed to update chat")
+			}
+		}
+
+		if contacts := messageContacts(evt.Message); contacts != nil {
+			postmap["contacts"] = contacts
+		}
+
+		// Messages in chats with disappearing messages carry the timer
+		if expiration := getContextInfo(evt.Message).GetExpiration(); expiration > 0 {
+			mycli.updateDisappearingTimer(evt.Info.Chat, expiration)
+		}
+
 		if img := evt.Message.GetImageMessage(); img != nil {
 			path, err := downloadAndSaveMedia(mycli, evt, "image",
 				func() ([]byte, error) { return mycli.WAClient.Download(img) },
@@ -573,6 +749,21 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 		}
 
+		// Videos are not saved as they can be large, and remain available
+		// through /chat/download. View once media can not be downloaded
+		// again once opened, so those videos are the exception.
+		if video := evt.Message.GetVideoMessage(); video != nil && evt.IsViewOnce {
+			path, err := downloadAndSaveMedia(mycli, evt, "video",
+				func() ([]byte, error) { return mycli.WAClient.Download(video) },
+				video.GetMimetype,
+				exPath)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to handle video")
+			} else {
+				log.Info().Str("path", path).Msg("Video saved")
+			}
+		}
+
 		if document := evt.Message.GetDocumentMessage(); document != nil {
 			path, err := downloadAndSaveMedia(mycli, evt, "document",
 				func() ([]byte, error) { return mycli.WAClient.Download(document) },
@@ -587,6 +778,19 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		changes, err := applyReceipt(mycli.db, mycli.userID, evt)
+		if err != nil {
+			log.Error().Err(err).Strs("id", evt.MessageIDs).Msg("Failed to update message status")
+		}
+		for i := range changes {
+			mycli.myEventHandler(&changes[i])
+		}
+		// Chats read on another device of the user are no longer unread
+		if (evt.Type == types.ReceiptTypeRead && evt.IsFromMe) || evt.Type == types.ReceiptTypeReadSelf {
+			if err := markChatRead(mycli.db, mycli.userID, evt.Chat, true); err != nil {
+				log.Error().Err(err).Str("chat", evt.Chat.String()).Msg("Failed to update unread count")
+			}
+		}
 		if evt.Type == types.ReceiptTypeRead || evt.Type == types.ReceiptTypeReadSelf {
 			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Time("timestamp", evt.Timestamp).Msg("Message was read")
 			if evt.Type == types.ReceiptTypeRead {
@@ -601,6 +805,44 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			// Discard webhooks for inactive or other delivery types
 			return
 		}
+	case *messageStatusEvent:
+		postmap["type"] = "MessageStatus"
+		delete(postmap, "event")
+		dowebhook = 1
+		postmap["messageId"] = evt.Id
+		postmap["chat"] = evt.Chat.String()
+		if !evt.Participant.IsEmpty() {
+			postmap["participant"] = evt.Participant.String()
+		}
+		postmap["status"] = evt.Status
+		postmap["timestamp"] = evt.Timestamp
+		log.Info().Str("id", evt.Id).Str("chat", evt.Chat.String()).Str("status", evt.Status).Msg("Message status changed")
+	case *sendResultEvent:
+		postmap["type"] = "SendResult"
+		delete(postmap, "event")
+		dowebhook = 1
+		postmap["messageId"] = evt.Id
+		postmap["chat"] = evt.Chat.String()
+		postmap["status"] = evt.Status
+		postmap["timestamp"] = evt.Timestamp
+		if evt.Error != "" {
+			postmap["error"] = evt.Error
+		}
+	case *scheduledSendEvent:
+		postmap["type"] = "ScheduledSend"
+		delete(postmap, "event")
+		dowebhook = 1
+		postmap["scheduleId"] = evt.ScheduleId
+		postmap["messageId"] = evt.MessageId
+		postmap["chat"] = evt.Chat.String()
+		postmap["status"] = evt.Status
+		postmap["timestamp"] = evt.Timestamp
+		if evt.Error != "" {
+			postmap["error"] = evt.Error
+		}
+		if !evt.NextRun.IsZero() {
+			postmap["nextRun"] = evt.NextRun
+		}
 	case *events.Presence:
 		postmap["type"] = "Presence"
 		dowebhook = 1
@@ -617,35 +859,82 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 	case *events.HistorySync:
 		postmap["type"] = "HistorySync"
+		delete(postmap, "event")
 		dowebhook = 1
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				log.Error().Err(errDir).Msg("Could not create user directory")
-				return
+		summary, err := ingestHistorySync(mycli.WAClient, mycli.db, mycli.userID, evt.Data)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to ingest history sync")
+		}
+		postmap["syncType"] = summary.SyncType
+		postmap["chunkOrder"] = summary.ChunkOrder
+		postmap["progress"] = summary.Progress
+		postmap["conversations"] = summary.Conversations
+		postmap["messages"] = summary.Messages
+		postmap["storedMessages"] = summary.StoredMessages
+		postmap["failedMessages"] = summary.FailedMessages
+		postmap["totalChunks"] = summary.TotalChunks
+		postmap["totalConversations"] = summary.TotalConversations
+		postmap["totalMessages"] = summary.TotalMessages
+
+		// On demand syncs answer backfill requests, one chat at a time
+		if evt.Data.GetSyncType() == waProto.HistorySync_ON_DEMAND {
+			for i := range summary.chats {
+				jobID, err := completeBackfillJob(mycli.db, mycli.userID, &summary.chats[i])
+				if err != nil {
+					log.Error().Err(err).Str("chat", summary.chats[i].JID.String()).Msg("Failed to complete backfill job")
+				} else if jobID != "" {
+					postmap["jobId"] = jobID
+					log.Info().Str("job", jobID).Int("messages", summary.chats[i].Messages).Msg("Backfill completed")
+				}
 			}
 		}
-
-		id := atomic.AddInt32(&historySyncID, 1)
-		fileName := filepath.Join(userDirectory, "history-"+strconv.Itoa(int(id))+".json")
-		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to open file to write history sync")
-			return
+		log.Info().Str("type", summary.SyncType).Uint32("chunk", summary.ChunkOrder).Uint32("progress", summary.Progress).
+			Int("conversations", summary.Conversations).Int("messages", summary.Messages).Msg("History sync received")
+	case *events.GroupInfo:
+		if evt.Ephemeral != nil {
+			mycli.updateDisappearingTimer(evt.JID, groupDisappearingTimer(*evt.Ephemeral))
 		}
-		enc := json.NewEncoder(file)
-		enc.SetIndent("", "  ")
-		err = enc.Encode(evt.Data)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to write history sync")
-			return
+		if evt.Name != nil {
+			if err := setChatName(mycli.db, mycli.userID, evt.JID, evt.Name.Name); err != nil {
+				log.Error().Err(err).Str("group", evt.JID.String()).Msg("Failed to save group name")
+			}
+		}
+		log.Info().Str("group", evt.JID.String()).Msg("Group info changed")
+	case *events.JoinedGroup:
+		if err := setChatName(mycli.db, mycli.userID, evt.JID, evt.Name); err != nil {
+			log.Error().Err(err).Str("group", evt.JID.String()).Msg("Failed to save group name")
+		}
+		log.Info().Str("group", evt.JID.String()).Msg("Joined group")
+	case *events.Archive:
+		if err := setChatArchived(mycli.db, mycli.userID, evt.JID, evt.Action.GetArchived()); err != nil {
+			log.Error().Err(err).Str("chat", evt.JID.String()).Msg("Failed to update archived chat")
+		}
+	case *events.Pin:
+		if err := setChatPinned(mycli.db, mycli.userID, evt.JID, evt.Action.GetPinned()); err != nil {
+			log.Error().Err(err).Str("chat", evt.JID.String()).Msg("Failed to update pinned chat")
+		}
+	case *events.Mute:
+		// The end of the mute comes in milliseconds, muted_until is kept in
+		// seconds like the history sync writes it
+		var until int64
+		if evt.Action.GetMuted() {
+			until = evt.Action.GetMuteEndTimestamp()
+			if until != mutedForever {
+				until /= 1000
+			}
+		}
+		if err := setChatMutedUntil(mycli.db, mycli.userID, evt.JID, until); err != nil {
+			log.Error().Err(err).Str("chat", evt.JID.String()).Msg("Failed to update muted chat")
+		}
+	case *events.MarkChatAsRead:
+		if err := markChatRead(mycli.db, mycli.userID, evt.JID, evt.Action.GetRead()); err != nil {
+			log.Error().Err(err).Str("chat", evt.JID.String()).Msg("Failed to update unread count")
+		}
+	case *events.MediaRetry:
+		if !deliverMediaRetry(mycli.userID, evt) {
+			log.Info().Str("id", evt.MessageID).Msg("Ignoring unrequested media retry")
 		}
-		log.Info().Str("filename", fileName).Msg("Wrote history sync")
-		_ = file.Close()
 	case *events.AppState:
 		log.Info().Str("index", fmt.Sprintf("%+v", evt.Index)).Str("actionValue", fmt.Sprintf("%+v", evt.SyncActionValue)).Msg("App state event received")
 	case *events.LoggedOut:
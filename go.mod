@@ -16,6 +16,8 @@ require (
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/vincent-petithory/dataurl v1.0.0
 	go.mau.fi/whatsmeow v0.0.0-20240327124018-350073db195c
+	golang.org/x/image v0.23.0
+	golang.org/x/net v0.21.0
 	google.golang.org/protobuf v1.33.0
 	modernc.org/sqlite v1.22.1
 )
@@ -36,7 +38,6 @@ require (
 	go.mau.fi/util v0.4.1 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/mod v0.11.0 // indirect
-	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/tools v0.10.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1